@@ -1,3 +1,8 @@
 module github.com/appadeia/alpmbuild
 
 go 1.12
+
+require (
+	github.com/ProtonMail/go-crypto v1.1.6
+	golang.org/x/crypto v0.17.0
+)
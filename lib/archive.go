@@ -0,0 +1,444 @@
+package lib
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// %install doesn't really run as root, so the files it creates belong to
+// whoever runs alpmbuild. Packages are written from Go instead of with
+// bsdtar, so that who owns a file in the package can be taken from the
+// %attr and %defattr directives of %files:
+//
+//	%files
+//	%defattr(0644,root,root,0755)
+//	/usr/share/hello
+//	%attr(4755,root,games) /usr/bin/hello
+//
+// Files that aren't listed belong to root and keep their mode. This is the
+// only way to give files to other users: %install runs in a user namespace
+// that only has root in it, so install -o or chown to anyone else fails.
+
+// fileAttributes are the mode and ownership of a file in a package. Empty
+// fields, written as "-" in the specfile, leave the file as it is.
+type fileAttributes struct {
+	Mode    string
+	User    string
+	Group   string
+	DirMode string
+}
+
+// fileEntry is a path of %files, along with its attributes.
+type fileEntry struct {
+	Path       string
+	Attributes fileAttributes
+	// Dir is set by %dir, and keeps the entry from applying to the
+	// contents of the directory.
+	Dir bool
+	// Config is set by %config, and has pacman back the file up.
+	Config bool
+}
+
+var fileDirective = regexp.MustCompile(`^%(attr|defattr|verify|config|dir|doc|license|ghost)\b(\([^)]*\))?`)
+
+// parseAttributes parses the arguments of %attr or %defattr.
+func parseAttributes(directive, arguments string) (fileAttributes, error) {
+	var attributes fileAttributes
+	fields := strings.Split(strings.Trim(arguments, "()"), ",")
+	if len(fields) < 3 || len(fields) > 4 || (directive == "attr" && len(fields) != 3) {
+		return attributes, fmt.Errorf("%s should look like %s", highlight("%"+directive+arguments), highlight("%"+directive+"(mode,user,group)"))
+	}
+	values := []*string{&attributes.Mode, &attributes.User, &attributes.Group, &attributes.DirMode}
+	for index, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "-" {
+			continue
+		}
+		if index == 0 || index == 3 {
+			if _, err := strconv.ParseUint(field, 8, 32); err != nil {
+				return attributes, fmt.Errorf("%s is not an octal file mode in %s", highlight(field), highlight("%"+directive+arguments))
+			}
+		}
+		*values[index] = field
+	}
+	return attributes, nil
+}
+
+// parseFileList parses the lines of %files into the paths they list.
+func parseFileList(lines []string) ([]fileEntry, error) {
+	var entries []fileEntry
+	var defaults fileAttributes
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		attributes := defaults
+		dir, config := false, false
+		for {
+			match := fileDirective.FindStringSubmatch(line)
+			if match == nil {
+				break
+			}
+			line = strings.TrimSpace(strings.TrimPrefix(line, match[0]))
+			switch match[1] {
+			case "defattr":
+				parsed, err := parseAttributes(match[1], match[2])
+				if err != nil {
+					return nil, err
+				}
+				defaults, attributes = parsed, parsed
+			case "attr":
+				parsed, err := parseAttributes(match[1], match[2])
+				if err != nil {
+					return nil, err
+				}
+				if parsed.Mode != "" {
+					attributes.Mode, attributes.DirMode = parsed.Mode, parsed.Mode
+				}
+				if parsed.User != "" {
+					attributes.User = parsed.User
+				}
+				if parsed.Group != "" {
+					attributes.Group = parsed.Group
+				}
+			case "dir":
+				dir = true
+			case "config":
+				config = true
+			}
+		}
+		for _, path := range strings.Fields(line) {
+			entries = append(entries, fileEntry{
+				Path:       path,
+				Attributes: attributes,
+				Dir:        dir,
+				Config:     config,
+			})
+		}
+	}
+	return entries, nil
+}
+
+// fileEntries returns the paths listed in %files of the package.
+func (pkg PackageContext) fileEntries() []fileEntry {
+	entries, err := parseFileList(pkg.Files)
+	if err != nil {
+		outputError("Malformed files listing: " + err.Error())
+	}
+	return entries
+}
+
+// filePaths returns the paths listed in %files of the package, without
+// their directives.
+func (pkg PackageContext) filePaths() []string {
+	var paths []string
+	for _, entry := range pkg.fileEntries() {
+		paths = append(paths, entry.Path)
+	}
+	return paths
+}
+
+// attributesFor returns the attributes of the file at path, relative to
+// the package root. The last entry that lists the file or a directory it
+// is in wins, like with rpm. Man and info pages are listed by their names
+// before zipman compressed them, so a .gz file is also matched without
+// its suffix.
+func attributesFor(entries []fileEntry, path string) fileAttributes {
+	var attributes fileAttributes
+	for _, entry := range entries {
+		pattern := strings.TrimPrefix(filepath.Clean("/"+entry.Path), "/")
+		matched, _ := filepath.Match(pattern, path)
+		if !matched && strings.HasSuffix(path, ".gz") {
+			matched, _ = filepath.Match(pattern, strings.TrimSuffix(path, ".gz"))
+		}
+		if !matched && !entry.Dir {
+			for parent := filepath.Dir(path); parent != "." && !matched; parent = filepath.Dir(parent) {
+				matched, _ = filepath.Match(pattern, parent)
+			}
+		}
+		if matched {
+			attributes = entry.Attributes
+		}
+	}
+	return attributes
+}
+
+// packageOwner turns user and group names into the IDs stored in packages
+// along with the names.
+type packageOwner struct {
+	ids map[string]int
+}
+
+var owners packageOwner
+
+func (owner *packageOwner) id(name string, group bool) int {
+	if name == "" || name == "root" {
+		return 0
+	}
+	key := "u:" + name
+	if group {
+		key = "g:" + name
+	}
+	if id, ok := owner.ids[key]; ok {
+		return id
+	}
+	var idString string
+	var err error
+	if group {
+		var found *user.Group
+		found, err = user.LookupGroup(name)
+		if err == nil {
+			idString = found.Gid
+		}
+	} else {
+		var found *user.User
+		found, err = user.Lookup(name)
+		if err == nil {
+			idString = found.Uid
+		}
+	}
+	id, _ := strconv.Atoi(idString)
+	if err != nil {
+		outputWarning(fmt.Sprintf("%s does not exist on this system, so it will only be stored by name in the package", highlight(name)))
+	}
+	if owner.ids == nil {
+		owner.ids = map[string]int{}
+	}
+	owner.ids[key] = id
+	return id
+}
+
+// packageFile is a file in a package root, as it goes into the package.
+type packageFile struct {
+	// Path is relative to the package root.
+	Path  string
+	Info  os.FileInfo
+	Link  string
+	Mode  int64
+	User  string
+	Uid   int
+	Group string
+	Gid   int
+}
+
+// packageFiles lists the files in the package root with the mode and
+// ownership they have in the package. The metadata files come first, as
+// pacman expects .PKGINFO to be at the start of the package.
+func (pkg PackageContext) packageFiles() ([]packageFile, error) {
+	root := pkg.PackageRoot()
+	entries := pkg.fileEntries()
+
+	var paths []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root {
+			relative, _ := filepath.Rel(root, path)
+			paths = append(paths, relative)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rank := func(path string) int {
+		switch {
+		case path == ".PKGINFO":
+			return 0
+		case !strings.Contains(path, "/") && strings.HasPrefix(path, "."):
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		if rank(paths[i]) != rank(paths[j]) {
+			return rank(paths[i]) < rank(paths[j])
+		}
+		return paths[i] < paths[j]
+	})
+
+	var files []packageFile
+	for _, path := range paths {
+		info, err := os.Lstat(filepath.Join(root, path))
+		if err != nil {
+			return nil, err
+		}
+		file := packageFile{
+			Path: path,
+			Info: info,
+			Mode: int64(info.Mode().Perm()),
+		}
+		if info.Mode()&os.ModeSetuid != 0 {
+			file.Mode |= 04000
+		}
+		if info.Mode()&os.ModeSetgid != 0 {
+			file.Mode |= 02000
+		}
+		if info.Mode()&os.ModeSticky != 0 {
+			file.Mode |= 01000
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			file.Link, err = os.Readlink(filepath.Join(root, path))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var attributes fileAttributes
+		if rank(path) == 2 {
+			attributes = attributesFor(entries, path)
+		}
+		mode := attributes.Mode
+		if info.IsDir() {
+			mode = attributes.DirMode
+		}
+		if mode != "" && info.Mode()&os.ModeSymlink == 0 {
+			file.Mode, _ = strconv.ParseInt(mode, 8, 64)
+		}
+		file.User = defaultString(attributes.User, "root")
+		file.Group = defaultString(attributes.Group, "root")
+		file.Uid = owners.id(file.User, false)
+		file.Gid = owners.id(file.Group, true)
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// mtreeEscape escapes a path the way libarchive's mtree writer does.
+func mtreeEscape(path string) string {
+	var escaped strings.Builder
+	for _, char := range []byte(path) {
+		if char <= ' ' || char >= 127 || char == '\\' || char == '#' || char == '=' {
+			fmt.Fprintf(&escaped, "\\%03o", char)
+		} else {
+			escaped.WriteByte(char)
+		}
+	}
+	return escaped.String()
+}
+
+// writeMTree writes the .MTREE of files, which pacman uses to check an
+// installed package, to out.
+func writeMTree(root string, files []packageFile, out io.Writer) error {
+	compressed := gzip.NewWriter(out)
+	fmt.Fprintln(compressed, "#mtree")
+	for _, file := range files {
+		if file.Path == ".MTREE" {
+			continue
+		}
+		line := fmt.Sprintf("./%s time=%d.0 uid=%d gid=%d mode=%o", mtreeEscape(file.Path), file.Info.ModTime().Unix(), file.Uid, file.Gid, file.Mode)
+		switch {
+		case file.Info.IsDir():
+			line += " type=dir"
+		case file.Link != "":
+			line += " type=link link=" + mtreeEscape(file.Link)
+		default:
+			md5sum, sha256sum := md5.New(), sha256.New()
+			err := hashFile(filepath.Join(root, file.Path), md5sum, sha256sum)
+			if err != nil {
+				return err
+			}
+			line += fmt.Sprintf(
+				" type=file size=%d md5digest=%s sha256digest=%s",
+				file.Info.Size(),
+				hex.EncodeToString(md5sum.Sum(nil)),
+				hex.EncodeToString(sha256sum.Sum(nil)),
+			)
+		}
+		fmt.Fprintln(compressed, line)
+	}
+	return compressed.Close()
+}
+
+// writeArchive writes files as a tar archive to out.
+func writeArchive(root string, files []packageFile, out io.Writer) error {
+	archive := tar.NewWriter(out)
+	for _, file := range files {
+		header, err := tar.FileInfoHeader(file.Info, file.Link)
+		if err != nil {
+			return err
+		}
+		header.Name = file.Path
+		if file.Info.IsDir() {
+			header.Name += "/"
+		}
+		header.Mode = file.Mode
+		header.Uid, header.Gid = file.Uid, file.Gid
+		header.Uname, header.Gname = file.User, file.Group
+		header.AccessTime, header.ChangeTime = header.ModTime, header.ModTime
+		err = archive.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		if !file.Info.Mode().IsRegular() {
+			continue
+		}
+		contents, err := os.Open(filepath.Join(root, file.Path))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(archive, contents)
+		contents.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// compressTo runs the compressor of the chosen compression type, which
+// writes what is written to the returned pipe to output. wait waits for the
+// compressor to finish.
+func compressTo(output *os.File) (pipe io.WriteCloser, wait func() error, err error) {
+	compressor := CompressionTypes[*compressionType].Compressor
+	cmd := exec.Command(compressor[0], compressor[1:]...)
+	cmd.Stdout = output
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	pipe, err = cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+	return pipe, func() error {
+		err := cmd.Wait()
+		if err != nil {
+			return fmt.Errorf("%s failed: %s", compressor[0], strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFileList(t *testing.T) {
+	entries, err := parseFileList([]string{
+		"%defattr(0644,root,root,0755)",
+		"/usr/share/hello",
+		"%attr(4755,-,games) /usr/bin/hello",
+		"%dir %attr(-,http,http) /srv/hello",
+		"%doc /usr/share/doc/hello/README",
+		"%attr(0600,-,games) /usr/share/man/man6/hello.6",
+		"%config(noreplace) %attr(0640,-,games) /etc/hello.conf",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]fileAttributes{
+		"usr/share/hello/greeting.txt":  {"0644", "root", "root", "0755"},
+		"usr/bin/hello":                 {"4755", "root", "games", "4755"},
+		"srv/hello":                     {"0644", "http", "http", "0755"},
+		"srv/hello/cache":               {},
+		"usr/share/doc/hello/README":    {"0644", "root", "root", "0755"},
+		"usr/share/man/man6/hello.6.gz": {"0600", "root", "games", "0600"},
+		"etc/hello.conf":                {"0640", "root", "games", "0640"},
+	} {
+		if attributes := attributesFor(entries, path); attributes != expected {
+			t.Errorf("%s: expected %+v, got %+v", path, expected, attributes)
+		}
+	}
+
+	if _, err := parseFileList([]string{"%attr(rwx,root,root) /usr/bin/hello"}); err == nil {
+		t.Errorf("a symbolic mode was accepted")
+	}
+}
+
+func TestWriteArchive(t *testing.T) {
+	root := t.TempDir()
+	saved := directories
+	defer func() { directories = saved }()
+	directories = buildDirectories{BuildRoot: root}
+
+	for path, contents := range map[string]string{
+		".PKGINFO":      "pkgname = hello\n",
+		"usr/bin/hello": "#!/bin/sh\necho hello\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, path)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, path), []byte(contents), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pkg := PackageContext{Files: []string{"%attr(4750,root,root) /usr/bin/hello"}}
+	files, err := pkg.packageFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files[0].Path != ".PKGINFO" {
+		t.Errorf(".PKGINFO should come first, not %s", files[0].Path)
+	}
+
+	var archive bytes.Buffer
+	if err := writeArchive(root, files, &archive); err != nil {
+		t.Fatal(err)
+	}
+	reader := tar.NewReader(&archive)
+	modes := map[string]int64{}
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			break
+		}
+		if header.Uid != 0 || header.Uname != "root" {
+			t.Errorf("%s belongs to %s (%d)", header.Name, header.Uname, header.Uid)
+		}
+		modes[header.Name] = header.Mode
+	}
+	if modes["usr/bin/hello"] != 04750 || modes["usr/"] != 0755 {
+		t.Errorf("unexpected modes %v", modes)
+	}
+
+	var mtree bytes.Buffer
+	if err := writeMTree(root, files, &mtree); err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := gzip.NewReader(&mtree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadAll(uncompressed)
+	if !strings.Contains(string(contents), "./usr/bin/hello time=") || !strings.Contains(string(contents), "uid=0 gid=0 mode=4750 type=file size=21") {
+		t.Errorf("unexpected mtree:\n%s", contents)
+	}
+}
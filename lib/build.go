@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/appadeia/alpmbuild/lib/libalpm"
 	"github.com/appadeia/alpmbuild/lib/librpm"
 )
 
@@ -31,12 +32,25 @@ import (
 */
 
 func ParsePackage(data string) PackageContext {
-	if !*fakeroot {
-		outputStatus("Parsing package...")
+	outputStatus("Parsing package...")
+
+	// A line ending in a backslash continues on the next one. The lines are
+	// joined, but keep the number of the line they start on, so that what
+	// is reported about them is on the right line of the specfile.
+	var specLines []string
+	var lineNumbers []int
+	continued := false
+	for number, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		joined := strings.TrimSuffix(line, "\\")
+		if continued {
+			specLines[len(specLines)-1] += joined
+		} else {
+			specLines = append(specLines, joined)
+			lineNumbers = append(lineNumbers, number)
+		}
+		continued = joined != line
 	}
 
-	data = strings.ReplaceAll(data, "\\\n", "")
-
 	lex := PackageContext{}
 
 	lex.Subpackages = make(map[string]PackageContext)
@@ -50,7 +64,8 @@ func ParsePackage(data string) PackageContext {
 	currentScriptletSubpackage := ""
 
 mainParseLoop:
-	for currentLine, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+	for i, line := range specLines {
+		currentLine := lineNumbers[i]
 		// Blank lines are useless to us.
 		if line == "" {
 			continue
@@ -67,23 +82,19 @@ mainParseLoop:
 				macros := librpm.DumpMacroNamesAsString()
 
 				if len(macros) > 0 {
-					if !*fakeroot {
-						outputWarningHighlight(
-							"Macro not expanded on line "+strconv.Itoa(currentLine+1)+": "+highlight(matchString),
-							line,
-							"Did you mean to use "+highlight("%{"+ClosestString(matchString, macros)+"}")+"?",
-							strings.Index(line, matchString), len(matchString),
-						)
-					}
+					outputWarningHighlight(
+						"Macro not expanded on line "+strconv.Itoa(currentLine+1)+": "+highlight(matchString),
+						line,
+						"Did you mean to use "+highlight("%{"+ClosestString(matchString, macros)+"}")+"?",
+						strings.Index(line, matchString), len(matchString),
+					)
 				} else {
-					if !*fakeroot {
-						outputWarningHighlight(
-							"Macro not expanded on line "+strconv.Itoa(currentLine+1)+": "+highlight(matchString),
-							line,
-							"",
-							strings.Index(line, matchString), len(matchString),
-						)
-					}
+					outputWarningHighlight(
+						"Macro not expanded on line "+strconv.Itoa(currentLine+1)+": "+highlight(matchString),
+						line,
+						"",
+						strings.Index(line, matchString), len(matchString),
+					)
 				}
 			}
 		}
@@ -103,6 +114,9 @@ mainParseLoop:
 				case "NoFileCheck":
 					*checkFiles = false
 					continue mainParseLoop
+				case "Options":
+					specOptions = append(specOptions, fields[2:]...)
+					continue mainParseLoop
 				case "ReasonFor":
 					if len(fields) < 3 {
 						lineWithAdd := line + "          "
@@ -141,26 +155,22 @@ mainParseLoop:
 						)
 					}
 				default:
-					if !*fakeroot {
-						outputWarningHighlight(
-							"Invalid #!alpmbuild directive "+highlight(fields[1])+"on line "+strconv.Itoa(currentLine+1),
-							line,
-							"Did you mean to use "+highlight(ClosestString(fields[1], PossibleDirectives))+"?",
-							strings.Index(line, fields[1]), len(fields[1]),
-						)
-					}
+					outputWarningHighlight(
+						"Invalid #!alpmbuild directive "+highlight(fields[1])+"on line "+strconv.Itoa(currentLine+1),
+						line,
+						"Did you mean to use "+highlight(ClosestString(fields[1], PossibleDirectives))+"?",
+						strings.Index(line, fields[1]), len(fields[1]),
+					)
 					continue mainParseLoop
 				}
 			}
 
-			if !*fakeroot {
-				outputWarningHighlight(
-					"#!alpmbuild directive missing type",
-					line,
-					"",
-					0, 0,
-				)
-			}
+			outputWarningHighlight(
+				"#!alpmbuild directive missing type",
+				line,
+				"",
+				0, 0,
+			)
 		}
 
 		// Let's parse the key-value lines
@@ -177,7 +187,8 @@ mainParseLoop:
 			// Let's worry about our sources and patches...
 			if strings.HasPrefix(strings.ToLower(words[0]), "source") || strings.HasPrefix(strings.ToLower(words[0]), "patch") {
 				source := Source{
-					URL: evalInlineMacros(words[1], lex),
+					URL:  evalInlineMacros(words[1], lex),
+					Line: currentLine,
 				}
 				if len(words) > 2 {
 					slice := words[2:]
@@ -186,25 +197,33 @@ mainParseLoop:
 							if len(slice) > index+2 {
 								hashType := slice[index+1]
 								hashWord := slice[index+2]
+								if algorithm, ok := lookupChecksumAlgorithm(hashType); ok {
+									value := evalInlineMacros(hashWord, lex)
+									if !validChecksum(algorithm, value) {
+										outputErrorHighlight(
+											"Invalid "+hashType+" checksum on line "+strconv.Itoa(currentLine+1),
+											line,
+											"A "+hashType+" checksum is "+strconv.Itoa(algorithm.New().Size()*2)+" hexadecimal digits.",
+											strings.Index(line, hashWord), len(hashWord),
+										)
+									}
+									source.setChecksum(algorithm, value)
+									continue
+								}
 								switch hashType {
-								case "sha1":
-									source.Sha1 = evalInlineMacros(hashWord, lex)
-								case "sha224":
-									source.Sha224 = evalInlineMacros(hashWord, lex)
-								case "sha256":
-									source.Sha256 = evalInlineMacros(hashWord, lex)
-								case "sha384":
-									source.Sha384 = evalInlineMacros(hashWord, lex)
-								case "sha512":
-									source.Sha512 = evalInlineMacros(hashWord, lex)
-								case "md5":
-									source.Md5 = evalInlineMacros(hashWord, lex)
 								case "sig":
 									source.GPGSignatureURL = evalInlineMacros(hashWord, lex)
 								case "key":
 									source.GPGKeys = append(source.GPGKeys, evalInlineMacros(hashWord, lex))
+								case "mirror":
+									source.Mirrors = append(source.Mirrors, evalInlineMacros(hashWord, lex))
 								case "keyserver":
-									source.GPGKeyservers = append(source.GPGKeyservers, evalInlineMacros(hashWord, lex))
+									outputWarningHighlight(
+										"Keyservers are no longer consulted on line "+strconv.Itoa(currentLine+1),
+										line,
+										"Export the key to "+highlight(specKeyringDirectory+"/")+" next to the specfile instead.",
+										strings.Index(line, hashType), len(hashType),
+									)
 								default:
 									outputErrorHighlight(
 										"Invalid integrity tool on line "+strconv.Itoa(currentLine+1),
@@ -245,10 +264,18 @@ mainParseLoop:
 						}
 					}
 				}
+				if _, isVCS, err := parseVCSSource(source.URL); isVCS && err != nil {
+					outputErrorHighlight(
+						"Invalid VCS source on line "+strconv.Itoa(currentLine+1),
+						line,
+						err.Error(),
+						strings.Index(line, words[1]), len(words[1]),
+					)
+				}
 				if strings.HasPrefix(strings.ToLower(words[0]), "source") {
 					lex.Sources = append(lex.Sources, source)
 				} else {
-					lex.Sources = append(lex.Patches, source)
+					lex.Patches = append(lex.Patches, source)
 				}
 				continue mainParseLoop
 			}
@@ -315,48 +342,72 @@ mainParseLoop:
 						// If it doesn't, our code will break.
 						key := reflect.ValueOf(&currentPackage).Elem().FieldByName(field.Name)
 						if key.IsValid() {
-							itemArray := strings.Fields(evalInlineMacros(strings.TrimSpace(strings.TrimPrefix(line, words[0])), lex))
-							if !*ignoreDeps && !*fakeroot {
-								for _, packageField := range packageFields {
-									if field.Tag.Get("keyArray") == packageField {
-										for _, item := range itemArray {
-											if err, _ := lintPackageName(item); err != ValidName {
-												outputErrorHighlight(
-													fmt.Sprintf(
-														"%s is not a valid package identifier on line %s",
-														highlight(item),
-														strconv.Itoa(currentLine+1),
-													),
-													line,
-													fmt.Sprintf(
-														"Package identifiers can include %s, %s, %s, %s, %s, and %s",
-														highlight("alphanumeric characters"),
-														highlight("+"),
-														highlight("_"),
-														highlight("."),
-														highlight("@"),
-														highlight("-"),
-													),
-													strings.Index(line, item),
-													len(item),
-												)
-											}
-											if correction, needed := lintDependency(item); needed {
-												outputWarningHighlight(
-													fmt.Sprintf(
-														"Dependent package %s does not exist in repositories on line %s",
-														highlight(item),
-														strconv.Itoa(currentLine+1),
-													),
-													line,
-													fmt.Sprintf(
-														"Did you mean to use %s?",
-														highlight(correction),
-													),
-													strings.Index(line, item),
-													len(item),
-												)
-											}
+							value := evalInlineMacros(strings.TrimSpace(strings.TrimPrefix(line, words[0])), lex)
+							itemArray := strings.Fields(value)
+							isDependencyField, isRequirementField := false, isRequirement(keyName)
+							for _, packageField := range packageFields {
+								isDependencyField = isDependencyField || keyName == packageField
+							}
+							var optional []optionalDependency
+							if isDependencyField {
+								var err error
+								itemArray, optional, err = parseDependencyList(value, keyName)
+								if err != nil {
+									outputErrorHighlight(
+										"Invalid dependency on line "+strconv.Itoa(currentLine+1)+": "+err.Error(),
+										line,
+										"Dependencies look like "+highlight("name")+", "+highlight("name >= version")+" or "+highlight("name>=version"),
+										len(words[0])+1,
+										len(line)-len(words[0])-1,
+									)
+								}
+							}
+							if !*ignoreDeps {
+								if isDependencyField {
+									for _, dependency := range itemArray {
+										item := libalpm.ParseDepend(dependency).Name
+										// Dependencies on files that couldn't be translated
+										// are kept as they are, and have been warned about.
+										if _, ok := fileDependencyMatcher(item); ok {
+											continue
+										}
+										if err, _ := lintPackageName(item); err != ValidName {
+											outputErrorHighlight(
+												fmt.Sprintf(
+													"%s is not a valid package identifier on line %s",
+													highlight(item),
+													strconv.Itoa(currentLine+1),
+												),
+												line,
+												fmt.Sprintf(
+													"Package identifiers can include %s, %s, %s, %s, %s, and %s",
+													highlight("alphanumeric characters"),
+													highlight("+"),
+													highlight("_"),
+													highlight("."),
+													highlight("@"),
+													highlight("-"),
+												),
+												strings.Index(line, item),
+												len(item),
+											)
+										}
+										// Provisions and conflicts don't have to exist anywhere.
+										if !isRequirementField {
+											continue
+										}
+										if hint, needed := lintDependency(dependency); needed {
+											outputWarningHighlight(
+												fmt.Sprintf(
+													"Nothing in the repositories satisfies %s on line %s",
+													highlight(dependency),
+													strconv.Itoa(currentLine+1),
+												),
+												line,
+												hint,
+												strings.Index(line, item),
+												len(item),
+											)
 										}
 									}
 								}
@@ -383,6 +434,17 @@ mainParseLoop:
 							}
 
 							key.Set(reflect.AppendSlice(key, reflect.ValueOf(itemArray)))
+							// Rich dependencies can turn into optional ones.
+							for _, dep := range optional {
+								if currentPackage.Reasons == nil {
+									currentPackage.Reasons = make(map[string]string)
+								}
+								name := libalpm.ParseDepend(dep.Dependency).Name
+								if _, ok := currentPackage.Reasons[name]; !ok {
+									currentPackage.Reasons[name] = dep.Reason
+								}
+								currentPackage.Recommends = append(currentPackage.Recommends, dep.Dependency)
+							}
 							hasSet = true
 						}
 					}
@@ -396,14 +458,12 @@ mainParseLoop:
 			}
 
 			if !hasSet {
-				if !*fakeroot {
-					outputErrorHighlight(
-						highlight(words[0])+" is not a valid key on line "+strconv.Itoa(currentLine+1),
-						line,
-						"Did you mean to use "+highlight(ClosestString(words[0], PossibleKeys))+"?",
-						strings.Index(line, words[0]), len(words[0]),
-					)
-				}
+				outputErrorHighlight(
+					highlight(words[0])+" is not a valid key on line "+strconv.Itoa(currentLine+1),
+					line,
+					"Did you mean to use "+highlight(ClosestString(words[0], PossibleKeys))+"?",
+					strings.Index(line, words[0]), len(words[0]),
+				)
 			}
 			continue mainParseLoop
 		}
@@ -554,8 +614,18 @@ mainParseLoop:
 				InstallStage: &lex.Commands.Install,
 				CheckStage:   &lex.Commands.Check,
 			}
+			lines := map[Stage]*[]int{
+				PrepareStage: &lex.CommandLines.Prepare,
+				BuildStage:   &lex.CommandLines.Build,
+				InstallStage: &lex.CommandLines.Install,
+				CheckStage:   &lex.CommandLines.Check,
+			}
 			if str, ok := m[currentStage]; ok {
+				if dir := setupDirectory(line); dir != "" {
+					lex.buildsubdir = dir
+				}
 				*str = append(*str, evalInlineMacros(line, lex))
+				*lines[currentStage] = append(*lines[currentStage], currentLine+1)
 				continue mainParseLoop
 			}
 			if currentScriptletSubpackage == "" {
@@ -604,24 +674,25 @@ mainParseLoop:
 				continue mainParseLoop
 			}
 			if currentStage == FileStage {
-				var backup string
-				if strings.HasPrefix(line, "%config") {
-					backup = strings.TrimPrefix(evalInlineMacros(strings.TrimSpace(strings.TrimPrefix(line, "%config")), lex), "/")
+				// %config files are listed like any other file, so that they
+				// keep their %attr, and are backed up by pacman as well.
+				line = evalInlineMacros(line, lex)
+				var backup []string
+				if entries, err := parseFileList([]string{line}); err == nil {
+					for _, entry := range entries {
+						if entry.Config {
+							backup = append(backup, strings.TrimPrefix(entry.Path, "/"))
+						}
+					}
 				}
 				if currentFilesSubpackage == "" {
-					if backup != "" {
-						lex.Backup = append(lex.Backup, evalInlineMacros(backup, lex))
-					} else {
-						lex.Files = append(lex.Files, evalInlineMacros(line, lex))
-					}
+					lex.Files = append(lex.Files, line)
+					lex.Backup = append(lex.Backup, backup...)
 				} else {
 					if val, ok := lex.Subpackages[currentFilesSubpackage]; ok {
 						subpkg := val
-						if backup != "" {
-							subpkg.Backup = append(subpkg.Backup, evalInlineMacros(backup, lex))
-						} else {
-							subpkg.Files = append(subpkg.Files, evalInlineMacros(line, lex))
-						}
+						subpkg.Files = append(subpkg.Files, line)
+						subpkg.Backup = append(subpkg.Backup, backup...)
 						lex.Subpackages[currentFilesSubpackage] = subpkg
 					} else {
 						outputError("You cannot specify files for a subpackage if the subpackage has not been declared")
@@ -640,17 +711,6 @@ mainParseLoop:
 		outputError("Could not parse line " + strconv.Itoa(currentLine+1) + ":\n          " + line)
 	}
 
-	promptMissingDepsInstall(lex)
-
-	if len(lex.Commands.Prepare) == 0 {
-		if !*fakeroot {
-			outputStatus("Automatically setting up package...")
-		}
-		lex.Commands.Prepare = append(lex.Commands.Prepare, evalInlineMacros("%setup -q", lex))
-	}
-
-	lex.BuildPackage()
-
 	return lex
 }
 
@@ -658,14 +718,32 @@ var rawdata []byte
 
 // Build : Build a specfile, generating an Arch package.
 func Build(pathToRecipe string) error {
-	if !*fakeroot {
-		outputStatus("Reading specfile from " + pathToRecipe + "...")
-	}
+	outputStatus("Reading specfile from " + pathToRecipe + "...")
 	data, err := ioutil.ReadFile(pathToRecipe)
 	if err != nil {
 		return err
 	}
 	rawdata = data
-	ParsePackage(string(data))
+	loadMakepkgConf()
+
+	// The build tree has to be set up before parsing, so that macros such
+	// as %{buildroot} point into it.
+	tree, err := setupBuildTree(pathToRecipe)
+	if err != nil {
+		return err
+	}
+
+	lex := ParsePackage(string(data))
+
+	removeDependencies := installMissingDependencies(lex)
+	defer removeDependencies()
+
+	if len(lex.Commands.Prepare) == 0 {
+		outputStatus("Automatically setting up package...")
+		lex.Commands.Prepare = append(lex.Commands.Prepare, evalInlineMacros("%setup -q", lex))
+	}
+
+	lex.BuildPackage(tree)
+	tree.finish()
 	return nil
 }
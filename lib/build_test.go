@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSourcesAndPatches(t *testing.T) {
+	ignore := true
+	saved := ignoreDeps
+	defer func() { ignoreDeps = saved }()
+	ignoreDeps = &ignore
+
+	pkg := ParsePackage(`Name: hello
+Version: 1.0
+Release: 1
+Summary: Says hello
+License: MIT
+Source0: https://example.org/hello-1.0.tar.gz
+Patch0: fix-greeting.patch
+Patch1: https://example.org/fix-farewell.patch
+`)
+	if len(pkg.Sources) != 1 || pkg.Sources[0].URL != "https://example.org/hello-1.0.tar.gz" {
+		t.Errorf("unexpected sources %+v", pkg.Sources)
+	}
+	if len(pkg.Patches) != 2 || pkg.Patches[0].URL != "fix-greeting.patch" || pkg.Patches[1].URL != "https://example.org/fix-farewell.patch" {
+		t.Errorf("unexpected patches %+v", pkg.Patches)
+	}
+}
+
+func TestParseConfigFiles(t *testing.T) {
+	ignore := true
+	saved := ignoreDeps
+	defer func() { ignoreDeps = saved }()
+	ignoreDeps = &ignore
+
+	pkg := ParsePackage(`Name: hello
+Version: 1.0
+Release: 1
+Summary: Says hello
+License: MIT
+
+%files
+/usr/bin/hello
+%config(noreplace) %attr(0640,root,games) /etc/hello.conf
+`)
+	if !reflect.DeepEqual(pkg.Backup, []string{"etc/hello.conf"}) {
+		t.Errorf("unexpected backup %q", pkg.Backup)
+	}
+	if attributes := attributesFor(pkg.fileEntries(), "etc/hello.conf"); attributes.Mode != "0640" || attributes.Group != "games" {
+		t.Errorf("the %%attr of a %%config file was lost: %+v", attributes)
+	}
+}
+
+func TestParseCommandLines(t *testing.T) {
+	ignore := true
+	saved := ignoreDeps
+	defer func() { ignoreDeps = saved }()
+	ignoreDeps = &ignore
+
+	pkg := ParsePackage(`Name: hello
+Version: 1.0
+Release: 1
+Summary: Says hello
+License: MIT
+
+%build
+./configure \
+	--prefix=/usr
+
+make
+`)
+	if !reflect.DeepEqual(pkg.Commands.Build, []string{"./configure 	--prefix=/usr", "make"}) {
+		t.Errorf("unexpected commands %q", pkg.Commands.Build)
+	}
+	if !reflect.DeepEqual(pkg.CommandLines.Build, []int{8, 11}) {
+		t.Errorf("unexpected lines %v", pkg.CommandLines.Build)
+	}
+}
+
+func TestParseSetupDirectory(t *testing.T) {
+	ignore := true
+	saved := ignoreDeps
+	defer func() { ignoreDeps = saved }()
+	ignoreDeps = &ignore
+
+	pkg := ParsePackage(`Name: hello
+Version: 1.0
+Release: 1
+Summary: Says hello
+License: MIT
+Source0: https://example.org/hello-src.tar.gz
+
+%prep
+%setup -q -n %{name}-src
+
+%build
+make
+`)
+	if len(pkg.Commands.Prepare) != 1 || !strings.Contains(pkg.Commands.Prepare[0], "cd hello-src\n") {
+		t.Errorf("%%setup doesn't enter hello-src: %q", pkg.Commands.Prepare)
+	}
+	if dir := pkg.buildSubdirectory(); dir != "hello-src" {
+		t.Errorf("expected the sections to run in hello-src, not %s", dir)
+	}
+	if preamble := pkg.sectionPreamble("%build", "failed"); !strings.Contains(preamble, "hello-src'") {
+		t.Errorf("%%build doesn't enter hello-src:\n%s", preamble)
+	}
+}
+
+func TestParseSetupCheckout(t *testing.T) {
+	ignore := true
+	saved := ignoreDeps
+	defer func() { ignoreDeps = saved }()
+	ignoreDeps = &ignore
+
+	pkg := ParsePackage(`Name: hello
+Version: 1.0
+Release: 1
+Summary: Says hello
+License: MIT
+Source0: git+https://example.org/hello.git#tag=v1.0
+
+%prep
+%setup -q -n hello
+`)
+	if len(pkg.Commands.Prepare) != 1 || strings.Contains(pkg.Commands.Prepare[0], "rm -rf") || strings.Contains(pkg.Commands.Prepare[0], "cp -a") {
+		t.Errorf("%%setup -n of the checkout removes or copies it: %q", pkg.Commands.Prepare)
+	}
+	if !strings.Contains(pkg.Commands.Prepare[0], "cd hello\n") {
+		t.Errorf("%%setup doesn't enter the checkout: %q", pkg.Commands.Prepare)
+	}
+}
@@ -18,6 +18,8 @@ type BuildInfo struct {
 		GoVersion string
 		Packages  []libalpm.Package
 	}
+	// Environment is the environment the sections of the specfile ran in.
+	Environment   []string
 	SpecFile      []byte
 	Package       PackageContext
 	ParentPackage *PackageContext `json:",omitempty"`
@@ -31,21 +33,17 @@ func (pkg PackageContext) GenerateBuildInfo() {
 		parent = *pkg.parentPackage
 		different = true
 	}
-	pkgdir := ""
-	home, err := os.UserHomeDir()
-	if err != nil {
-		outputError(fmt.Sprintf("Failed to generate build info:\n%s", err.Error()))
-	}
-	if !pkg.IsSubpackage {
-		pkgdir = filepath.Join(home, "alpmbuild/package")
-	} else {
-		pkgdir = filepath.Join(home, "alpmbuild/subpackages", pkg.GetNevra())
-	}
+	pkgdir := pkg.PackageRoot()
 	os.Chdir(pkgdir)
-	pkgs, err := libalpm.ListInstalled()
+	installed, err := libalpm.ListInstalled()
 	if err != nil {
 		outputError(fmt.Sprintf("Failed to generate build info:\n%s", err.Error()))
 	}
+	// Only what was installed is recorded, not everything about it.
+	var pkgs []libalpm.Package
+	for _, pkg := range installed {
+		pkgs = append(pkgs, libalpm.Package{Name: pkg.Name, Version: pkg.Version})
+	}
 	buildInfo := BuildInfo{}
 	buildInfo.System = struct {
 		Arch      string
@@ -62,6 +60,7 @@ func (pkg PackageContext) GenerateBuildInfo() {
 		buildInfo.ParentPackage = &parent
 	}
 	buildInfo.Package = pkg
+	buildInfo.Environment = buildEnvironment(parent.Name)
 	buildInfo.SpecFile = rawdata
 	data, err := json.MarshalIndent(buildInfo, "", "\t")
 	if err != nil {
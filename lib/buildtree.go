@@ -0,0 +1,280 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// buildTree is the set of directories a single build works in. Every build
+// gets its own, so builds running at the same time can't see each other's
+// files. Each build tree is a subdirectory named after its ID in the build
+// directory, the buildroot, and the subpackage and source package
+// directories. The build scripts and the lock live in <topdir>/builds/<ID>.
+type buildTree struct {
+	ID     string
+	Record string
+	lock   *os.File
+	// keep is set for trees that are worth more than their packages, such
+	// as those of builds that stop early or resume an earlier build.
+	keep bool
+	// chroot is the clean chroot of the build, if it has one.
+	chroot *cleanChroot
+}
+
+// buildTreeDirectories returns the directories of the build tree with the
+// given ID, with base holding the configured directories.
+func buildTreeDirectories(base buildDirectories, id string) buildDirectories {
+	dirs := base
+	dirs.Build = filepath.Join(base.Build, id)
+	dirs.BuildRoot = filepath.Join(base.BuildRoot, id)
+	dirs.Subpackages = filepath.Join(base.Subpackages, id)
+	dirs.SourcePackages = filepath.Join(base.SourcePackages, id)
+	return dirs
+}
+
+func buildRecords() string {
+	return filepath.Join(directories.Top, "builds")
+}
+
+// newBuildTree creates and locks a fresh build tree for the package name.
+func newBuildTree(name string) (*buildTree, error) {
+	err := os.MkdirAll(buildRecords(), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	record, err := ioutil.TempDir(buildRecords(), name+"-")
+	if err != nil {
+		return nil, err
+	}
+	tree := &buildTree{
+		ID:     filepath.Base(record),
+		Record: record,
+	}
+	err = tree.acquire()
+	if err != nil {
+		return nil, err
+	}
+	// The ID only starts with the name, which other packages' names can
+	// start with too, so the name is saved for latestBuildTree.
+	return tree, ioutil.WriteFile(filepath.Join(record, "name"), []byte(name+"\n"), 0644)
+}
+
+// openBuildTree locks an existing build tree.
+func openBuildTree(id string) (*buildTree, error) {
+	record := filepath.Join(buildRecords(), id)
+	if _, err := os.Stat(record); err != nil {
+		return nil, fmt.Errorf("build tree %s does not exist", highlight(id))
+	}
+	tree := &buildTree{
+		ID:     id,
+		Record: record,
+	}
+	return tree, tree.acquire()
+}
+
+// latestBuildTree finds and locks the newest build tree of the package name
+// that no other build is using.
+func latestBuildTree(name string) (*buildTree, error) {
+	records, err := filepath.Glob(filepath.Join(buildRecords(), name+"-*"))
+	if err != nil {
+		return nil, err
+	}
+	modified := map[string]int64{}
+	for _, record := range records {
+		saved, err := ioutil.ReadFile(filepath.Join(record, "name"))
+		if err != nil || strings.TrimSpace(string(saved)) != name {
+			continue
+		}
+		if info, err := os.Stat(record); err == nil && info.IsDir() {
+			modified[record] = info.ModTime().UnixNano()
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return modified[records[i]] > modified[records[j]]
+	})
+	for _, record := range records {
+		if _, ok := modified[record]; !ok {
+			continue
+		}
+		tree := &buildTree{
+			ID:     filepath.Base(record),
+			Record: record,
+		}
+		if tree.acquire() == nil {
+			return tree, nil
+		}
+	}
+	return nil, fmt.Errorf("there is no build tree of %s to resume", highlight(name))
+}
+
+// acquire locks the build tree, failing if another build holds it.
+func (tree *buildTree) acquire() error {
+	lock, err := os.OpenFile(filepath.Join(tree.Record, "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		lock.Close()
+		return fmt.Errorf("build tree %s is in use by another build", highlight(tree.ID))
+	}
+	tree.lock = lock
+	return nil
+}
+
+// enter points directories at the build tree and creates it.
+func (tree *buildTree) enter() error {
+	directories = buildTreeDirectories(directories, tree.ID)
+	for _, dir := range []string{directories.Build, directories.BuildRoot, directories.Subpackages, directories.SourcePackages, tree.scripts()} {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tree *buildTree) scripts() string {
+	return filepath.Join(tree.Record, "scripts")
+}
+
+// writeScript saves a build script in the build tree and returns its path.
+func (tree *buildTree) writeScript(name, contents string) (string, error) {
+	path := filepath.Join(tree.scripts(), name+".sh")
+	return path, ioutil.WriteFile(path, []byte(contents), 0755)
+}
+
+// remove deletes the build tree.
+func (tree *buildTree) remove() error {
+	if tree.chroot != nil {
+		err := tree.chroot.remove()
+		if err != nil {
+			return err
+		}
+	}
+	for _, dir := range []string{directories.Build, directories.BuildRoot, directories.Subpackages, directories.SourcePackages, tree.Record} {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveRevisions records the revisions VCS sources were checked out at, for
+// the parts of the build that don't set up sources themselves.
+func (tree *buildTree) saveRevisions(pkg PackageContext) error {
+	revisions := map[string]string{}
+	for _, source := range append(append([]Source{}, pkg.Sources...), pkg.Patches...) {
+		if source.Revision != "" {
+			revisions[source.URL] = source.Revision
+		}
+	}
+	data, err := json.Marshal(revisions)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(tree.Record, "revisions.json"), data, 0644)
+}
+
+// loadRevisions fills in the revisions recorded by saveRevisions. A build
+// tree without any just has none.
+func (tree *buildTree) loadRevisions(pkg *PackageContext) error {
+	data, err := ioutil.ReadFile(filepath.Join(tree.Record, "revisions.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	revisions := map[string]string{}
+	err = json.Unmarshal(data, &revisions)
+	if err != nil {
+		return err
+	}
+	for index := range pkg.Sources {
+		pkg.Sources[index].Revision = revisions[pkg.Sources[index].URL]
+	}
+	for index := range pkg.Patches {
+		pkg.Patches[index].Revision = revisions[pkg.Patches[index].URL]
+	}
+	return nil
+}
+
+// setupBuildTree gives the build of the specfile at specPath its build
+// tree. A build that skips %prep resumes the newest tree of the package
+// unless told which one to use.
+func setupBuildTree(specPath string) (*buildTree, error) {
+	var tree *buildTree
+	var err error
+	name := strings.TrimSuffix(filepath.Base(specPath), ".spec")
+	switch {
+	case *buildTreeID != "":
+		tree, err = openBuildTree(*buildTreeID)
+		if err == nil {
+			tree.keep = true
+		}
+	case plan.From > prepStep:
+		tree, err = latestBuildTree(name)
+		if err == nil {
+			tree.keep = true
+		}
+	default:
+		tree, err = newBuildTree(name)
+		if err == nil {
+			tree.keep = plan.stopsEarly()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = tree.enter()
+	if err != nil {
+		return nil, err
+	}
+	atExit(tree.finish)
+	return tree, nil
+}
+
+// finish removes the build tree, unless it should be kept, and releases
+// it. It does nothing if the tree has already been released.
+func (tree *buildTree) finish() {
+	if tree.lock == nil {
+		return
+	}
+	if *keepBuildTree || tree.keep {
+		outputStatus("Keeping build tree " + highlight(tree.ID) + " in " + highlight(directories.Build))
+		if plan.stopsEarly() {
+			outputStatus("Continue it with " + highlight("-short-circuit") + ", or pick it with " + highlight("-buildTree "+tree.ID))
+		}
+	} else if err := tree.remove(); err != nil {
+		outputWarning("Failed to remove build tree " + highlight(tree.ID) + ": " + err.Error())
+	}
+	tree.lock.Close()
+	tree.lock = nil
+}
@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildTree(t *testing.T) {
+	top := t.TempDir()
+	saved := directories
+	defer func() { directories = saved }()
+	directories = buildDirectories{
+		Top:            top,
+		Build:          filepath.Join(top, "buildroot"),
+		BuildRoot:      filepath.Join(top, "package"),
+		Subpackages:    filepath.Join(top, "subpackages"),
+		SourcePackages: filepath.Join(top, "sourcepackages"),
+	}
+
+	first, err := newBuildTree("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newBuildTree("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == second.ID {
+		t.Fatalf("two builds were given the same tree %s", first.ID)
+	}
+
+	// Nobody else may take a tree that is in use.
+	if err := (&buildTree{ID: first.ID, Record: first.Record}).acquire(); err == nil {
+		t.Errorf("a locked build tree was acquired twice")
+	}
+
+	if err := first.enter(); err != nil {
+		t.Fatal(err)
+	}
+	if directories.BuildRoot != filepath.Join(top, "package", first.ID) {
+		t.Errorf("unexpected buildroot %s", directories.BuildRoot)
+	}
+	script, err := first.writeScript("build", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.remove(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{directories.Build, directories.BuildRoot, script} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", path)
+		}
+	}
+}
+
+func TestLatestBuildTree(t *testing.T) {
+	saved := directories
+	defer func() { directories = saved }()
+	directories = buildDirectories{Top: t.TempDir()}
+
+	if _, err := latestBuildTree("hello"); err == nil {
+		t.Errorf("a build tree was resumed without there being one")
+	}
+
+	older, err := newBuildTree("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	older.lock.Close()
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(older.Record, past, past)
+	newer, err := newBuildTree("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The newest tree is in use, so the older one is resumed.
+	resumed, err := latestBuildTree("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.ID != older.ID {
+		t.Errorf("resumed %s instead of %s", resumed.ID, older.ID)
+	}
+	resumed.lock.Close()
+
+	newer.lock.Close()
+	// Trees of packages whose names start with this one are left alone.
+	other, err := newBuildTree("hello-world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.lock.Close()
+	resumed, err = latestBuildTree("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.ID != newer.ID {
+		t.Errorf("resumed %s instead of %s", resumed.ID, newer.ID)
+	}
+}
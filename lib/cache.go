@@ -0,0 +1,451 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// sourceCache holds downloaded sources shared between builds. Entries are
+// named after the strongest checksum declared for a source, so the same
+// file is only downloaded once no matter which spec or URL asks for it.
+// Sources without checksums are keyed by their URL instead.
+type sourceCache struct {
+	root       string
+	downloader downloader
+	// bundles are directories laid out like the cache, usually gathered
+	// with "alpmbuild fetch". Sources found in them are copied into the
+	// cache instead of being downloaded.
+	bundles []string
+	// offline forbids downloading anything. Sources that are in neither
+	// the cache nor a bundle can't be fetched.
+	offline bool
+}
+
+// offlineError is returned for sources that would have to be downloaded
+// while offline.
+type offlineError struct {
+	URL string
+}
+
+func (err *offlineError) Error() string {
+	return err.URL + " is not in the source cache or any bundle"
+}
+
+// cacheEntry describes a file in the source cache.
+type cacheEntry struct {
+	Key      string
+	URL      string
+	Size     int64
+	LastUsed time.Time
+}
+
+const cacheURLSuffix = ".url"
+const cachePartialSuffix = ".download"
+const cacheLockSuffix = ".lock"
+
+// lockCacheEntry locks the cache entry at path, waiting for other builds
+// that hold it, like build trees are locked. The lock is released by
+// closing the returned file.
+func lockCacheEntry(path string) (*os.File, error) {
+	return openCacheLock(path, syscall.LOCK_EX)
+}
+
+// tryLockCacheEntry locks the cache entry at path like lockCacheEntry, but
+// fails instead of waiting if another build holds it.
+func tryLockCacheEntry(path string) (*os.File, error) {
+	return openCacheLock(path, syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func openCacheLock(path string, how int) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		lock, err := os.OpenFile(path+cacheLockSuffix, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = syscall.Flock(int(lock.Fd()), how)
+		if err != nil {
+			lock.Close()
+			return nil, err
+		}
+		// prune removes lock files along with their entries, so a lock
+		// that was waited for may no longer be the entry's lock.
+		locked, lockErr := lock.Stat()
+		current, currentErr := os.Stat(path + cacheLockSuffix)
+		if lockErr == nil && currentErr == nil && os.SameFile(locked, current) {
+			return lock, nil
+		}
+		lock.Close()
+	}
+}
+
+func defaultSourceCache() sourceCache {
+	cache := sourceCache{
+		root:       directories.Cache,
+		downloader: newDownloader(),
+		offline:    *offline,
+	}
+	if *sourceBundle != "" {
+		cache.bundles = append(cache.bundles, *sourceBundle)
+	}
+	return cache
+}
+
+// cacheKey names the cache entry for source, preferring the strongest
+// checksum the spec declares. Checksums are checked when the spec is
+// parsed, but as the key becomes a path, anything that could leave the
+// cache is refused here too.
+func (source Source) cacheKey() (string, error) {
+	for _, algorithm := range checksumAlgorithms {
+		if value := source.checksum(algorithm); value != "" {
+			key := algorithm.Name + "-" + strings.ToLower(value)
+			if strings.ContainsRune(key, filepath.Separator) || strings.Contains(key, "..") {
+				return "", fmt.Errorf("the %s checksum of %s is not a checksum", algorithm.Name, source.URL)
+			}
+			return key, nil
+		}
+	}
+	sum := sha256.Sum256([]byte(source.URL))
+	return "url-" + hex.EncodeToString(sum[:]), nil
+}
+
+func (cache sourceCache) path(key string) string {
+	return filepath.Join(cache.root, key)
+}
+
+// fetch returns the path of source in the cache, downloading it first if it
+// isn't there yet or if the cached copy no longer matches its checksums.
+// Downloads only enter the cache once they have been verified.
+func (cache sourceCache) fetch(source Source) (string, error) {
+	key, err := source.cacheKey()
+	if err != nil {
+		return "", err
+	}
+	entry := cache.path(key)
+
+	// Two sources or builds can share an entry, so don't fetch it twice at
+	// once.
+	lock, err := lockCacheEntry(entry)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Close()
+
+	if _, err := os.Stat(entry); err == nil {
+		outputStatus("Using cached copy of " + highlight(source.URL) + "...")
+		err = verifySourceChecksums(source, entry)
+		if err == nil {
+			now := time.Now()
+			os.Chtimes(entry, now, now)
+			return entry, nil
+		}
+		outputWarning("Cached copy of " + highlight(source.URL) + " is damaged, downloading it again: " + err.Error())
+		os.Remove(entry)
+	}
+
+	partial := entry + cachePartialSuffix
+	for _, bundle := range cache.bundles {
+		bundled := filepath.Join(bundle, key)
+		if _, err := os.Stat(bundled); err != nil {
+			continue
+		}
+		outputStatus("Copying " + highlight(source.URL) + " from " + highlight(bundle) + "...")
+		err = linkFile(bundled, partial)
+		if err == nil {
+			err = verifySourceChecksums(source, partial)
+		}
+		if err == nil {
+			return entry, cache.commit(source, partial, entry)
+		}
+		os.Remove(partial)
+		outputWarning("Bundled copy of " + highlight(source.URL) + " in " + highlight(bundle) + " can't be used: " + err.Error())
+	}
+
+	if cache.offline {
+		return "", &offlineError{URL: source.URL}
+	}
+	outputStatus("Downloading " + highlight(source.URL) + "...")
+	err = cache.downloader.download(partial, append([]string{source.URL}, source.Mirrors...)...)
+	if err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	err = verifySourceChecksums(source, partial)
+	if err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	return entry, cache.commit(source, partial, entry)
+}
+
+// commit moves a verified download into its place in the cache.
+func (cache sourceCache) commit(source Source, partial, entry string) error {
+	err := ioutil.WriteFile(entry+cacheURLSuffix, []byte(source.URL+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(partial, entry)
+}
+
+// cacheVCSDirectory is where mirrors of repositories are kept in the
+// cache, in a directory for each kind of repository.
+const cacheVCSDirectory = "vcs"
+
+// isCacheEntry reports whether name is the name of an entry, rather than
+// of its URL, its lock or a download of it.
+func isCacheEntry(name string) bool {
+	return !strings.HasSuffix(name, cacheURLSuffix) && !strings.HasSuffix(name, cacheLockSuffix) && !strings.Contains(name, cachePartialSuffix)
+}
+
+// directorySize adds up the sizes of the files in dir.
+func directorySize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// list lists the downloads and mirrors of repositories in the cache.
+func (cache sourceCache) list() ([]cacheEntry, error) {
+	files, err := ioutil.ReadDir(cache.root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []cacheEntry
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !isCacheEntry(name) {
+			continue
+		}
+		entries = append(entries, cacheEntry{
+			Key:      name,
+			Size:     file.Size(),
+			LastUsed: file.ModTime(),
+		})
+	}
+	mirrors, _ := filepath.Glob(filepath.Join(cache.root, cacheVCSDirectory, "*", "*"))
+	for _, mirror := range mirrors {
+		info, err := os.Stat(mirror)
+		if err != nil || !info.IsDir() || !isCacheEntry(info.Name()) {
+			continue
+		}
+		key, _ := filepath.Rel(cache.root, mirror)
+		entries = append(entries, cacheEntry{
+			Key:      key,
+			Size:     directorySize(mirror),
+			LastUsed: info.ModTime(),
+		})
+	}
+	for i, entry := range entries {
+		if url, err := ioutil.ReadFile(cache.path(entry.Key) + cacheURLSuffix); err == nil {
+			entries[i].URL = strings.TrimSpace(string(url))
+		}
+	}
+	return entries, nil
+}
+
+// prune removes entries that haven't been used since before, along with
+// any downloads that were interrupted and the locks of entries that are
+// gone. Entries and downloads of builds that are still running are left
+// alone.
+func (cache sourceCache) prune(before time.Time) ([]cacheEntry, error) {
+	entries, err := cache.list()
+	if err != nil {
+		return nil, err
+	}
+	var removed []cacheEntry
+	for _, entry := range entries {
+		if entry.LastUsed.After(before) {
+			continue
+		}
+		path := cache.path(entry.Key)
+		lock, err := tryLockCacheEntry(path)
+		if err != nil {
+			continue
+		}
+		err = os.RemoveAll(path)
+		if err == nil {
+			os.Remove(path + cacheURLSuffix)
+			os.Remove(path + cacheLockSuffix)
+		}
+		lock.Close()
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, entry)
+	}
+
+	for _, dir := range []string{cache.root, filepath.Join(cache.root, cacheVCSDirectory, "*")} {
+		partials, _ := filepath.Glob(filepath.Join(dir, "*"+cachePartialSuffix+"*"))
+		for _, partial := range partials {
+			entry := partial[:strings.LastIndex(partial, cachePartialSuffix)]
+			if lock, err := tryLockCacheEntry(entry); err == nil {
+				os.RemoveAll(partial)
+				lock.Close()
+			}
+		}
+		locks, _ := filepath.Glob(filepath.Join(dir, "*"+cacheLockSuffix))
+		for _, path := range locks {
+			entry := strings.TrimSuffix(path, cacheLockSuffix)
+			if _, err := os.Stat(entry); !os.IsNotExist(err) {
+				continue
+			}
+			if lock, err := tryLockCacheEntry(entry); err == nil {
+				os.Remove(path)
+				lock.Close()
+			}
+		}
+	}
+	return removed, nil
+}
+
+func humanSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// cacheCommand implements "alpmbuild cache list" and "alpmbuild cache prune".
+func cacheCommand(args []string) {
+	if len(args) < 1 {
+		outputError("Usage: alpmbuild cache list|prune")
+	}
+	cache := defaultSourceCache()
+
+	switch args[0] {
+	case "list":
+		entries, err := cache.list()
+		if err != nil {
+			outputError("Failed to read the source cache: " + err.Error())
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		var total int64
+		for _, entry := range entries {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", entry.Key, humanSize(entry.Size), entry.LastUsed.Format("2006-01-02"), entry.URL)
+			total += entry.Size
+		}
+		writer.Flush()
+		outputStatus(fmt.Sprintf("%d cached source(s) using %s in %s", len(entries), humanSize(total), cache.root))
+	case "prune":
+		set := flag.NewFlagSet("prune", flag.ExitOnError)
+		days := set.Int("days", 30, "Remove sources that haven't been used for this many days")
+		all := set.Bool("all", false, "Remove every cached source")
+		set.Parse(args[1:])
+
+		before := time.Now().AddDate(0, 0, -*days)
+		if *all {
+			before = time.Now()
+		}
+		removed, err := cache.prune(before)
+		if err != nil {
+			outputError("Failed to prune the source cache: " + err.Error())
+		}
+		var total int64
+		for _, entry := range removed {
+			total += entry.Size
+		}
+		outputStatus(fmt.Sprintf("Removed %d cached source(s), freeing %s", len(removed), humanSize(total)))
+	default:
+		outputError(highlight(args[0]) + " is not a cache command. Did you mean to use " + highlight(ClosestString(args[0], []string{"list", "prune"})) + "?")
+	}
+}
+
+// fetchCommand implements "alpmbuild fetch", which gathers the sources of
+// specfiles into a bundle for building them where there is no network,
+// using -offline and -bundle. Sources already in the cache are taken from
+// there.
+func fetchCommand(args []string) {
+	set := flag.NewFlagSet("fetch", flag.ExitOnError)
+	output := set.String("o", "alpmbuild-bundle", "The directory to gather the sources into")
+	set.Parse(args)
+	if set.NArg() < 1 {
+		outputError("Usage: alpmbuild fetch [-o DIRECTORY] SPECFILE...")
+	}
+
+	cache := defaultSourceCache()
+	bundle := sourceCache{
+		root:       *output,
+		downloader: cache.downloader,
+		bundles:    append([]string{cache.root}, cache.bundles...),
+		offline:    cache.offline,
+	}
+
+	count := 0
+	var failures []string
+	for _, specPath := range set.Args() {
+		data, err := ioutil.ReadFile(specPath)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", highlight(specPath), err.Error()))
+			continue
+		}
+		pkg := ParsePackage(string(data))
+		for _, source := range append(append([]Source{}, pkg.Sources...), pkg.Patches...) {
+			if vcs, ok := source.vcs(); ok {
+				_, err = bundle.mirrorVCS(vcs)
+			} else if isValidUrl(source.URL) {
+				_, err = bundle.fetch(source)
+				if err == nil && source.GPGSignatureURL != "" {
+					_, err = bundle.fetch(Source{URL: source.GPGSignatureURL})
+				}
+			} else {
+				// Local sources travel with the specfile.
+				continue
+			}
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s", highlight(source.URL), err.Error()))
+				continue
+			}
+			count++
+		}
+	}
+	if len(failures) > 0 {
+		outputError("Failed to gather sources:\n\t" + strings.Join(failures, "\n\t"))
+	}
+	outputStatus(fmt.Sprintf("Gathered %d source(s) into %s", count, highlight(*output)))
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheOffline(t *testing.T) {
+	sum := sha256.Sum256(testPayload)
+	source := Source{
+		URL:    "https://example.org/payload.tar.gz",
+		Sha256: hex.EncodeToString(sum[:]),
+	}
+
+	dir := t.TempDir()
+	cache := sourceCache{
+		root:    filepath.Join(dir, "cache"),
+		offline: true,
+	}
+	_, err := cache.fetch(source)
+	var missing *offlineError
+	if !errors.As(err, &missing) || missing.URL != source.URL {
+		t.Fatalf("expected %s to be missing, got %v", source.URL, err)
+	}
+
+	bundle := filepath.Join(dir, "bundle")
+	cache.bundles = []string{bundle}
+	key, err := source.cacheKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundled := sourceCache{root: bundle}.path(key)
+	if err := os.MkdirAll(bundle, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bundled, testPayload, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := cache.fetch(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownloaded(t, entry)
+}
+
+func TestCacheKey(t *testing.T) {
+	if _, err := (Source{URL: "https://example.org/payload.tar.gz", Sha256: "../../../victim"}).cacheKey(); err == nil {
+		t.Errorf("a checksum that leaves the cache was used as a key")
+	}
+	sha256, _ := lookupChecksumAlgorithm("sha256")
+	for value, valid := range map[string]bool{
+		strings.Repeat("ab", 32): true,
+		strings.Repeat("AB", 32): true,
+		strings.Repeat("ab", 31): false,
+		"../../../victim":        false,
+		strings.Repeat("zz", 32): false,
+	} {
+		if validChecksum(sha256, value) != valid {
+			t.Errorf("validChecksum(sha256, %q) should be %t", value, valid)
+		}
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	cache := sourceCache{root: t.TempDir()}
+	mirror := filepath.Join(cacheVCSDirectory, "git", "hello-0123456789ab")
+	if err := os.MkdirAll(cache.path(mirror), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"old", "running.download", "interrupted.download", filepath.Join(mirror, "HEAD")} {
+		if err := ioutil.WriteFile(cache.path(name), testPayload, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"old", "interrupted", mirror} {
+		lock, err := lockCacheEntry(cache.path(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock.Close()
+	}
+	lock, err := lockCacheEntry(cache.path("running"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+
+	entries, err := cache.list()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected old and the mirror to be listed, got %v, %v", entries, err)
+	}
+	removed, err := cache.prune(time.Now().Add(time.Hour))
+	if err != nil || len(removed) != 2 || removed[0].Key != "old" || removed[1].Key != mirror || removed[1].Size != int64(len(testPayload)) {
+		t.Fatalf("expected old and the mirror to be pruned, got %v, %v", removed, err)
+	}
+	for _, name := range []string{"running.download", "running" + cacheLockSuffix} {
+		if _, err := os.Stat(cache.path(name)); err != nil {
+			t.Errorf("%s of a running build was removed", name)
+		}
+	}
+	for _, name := range []string{"interrupted.download", "interrupted" + cacheLockSuffix, "old" + cacheLockSuffix, mirror, mirror + cacheLockSuffix} {
+		if _, err := os.Stat(cache.path(name)); err == nil {
+			t.Errorf("%s was kept", name)
+		}
+	}
+}
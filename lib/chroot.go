@@ -0,0 +1,326 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// With -clean-chroot, the sections of the specfile run in a root of their
+// own, like with makechrootpkg, instead of on the host. The template root
+// in <chrootdir>/root has nothing but base-devel installed. Every build
+// tree gets a snapshot of it, which the dependencies of the package are
+// installed into, so that a package only builds if it declares everything
+// it needs.
+//
+// Sections run as root in new user, mount, PID and network namespaces,
+// so no privileges are needed and the network is out of reach unless
+// -network is given. pacman needs to give files to other users than root,
+// so the user needs subordinate IDs in /etc/subuid and /etc/subgid, and
+// newuidmap and newgidmap, which come with shadow.
+
+// chrootPath is what the sections of a build in a clean chroot can run.
+const chrootPath = "/usr/local/sbin:/usr/local/bin:/usr/bin"
+
+// cleanChroot is the root of a build in a clean chroot.
+type cleanChroot struct {
+	Template string
+	Root     string
+}
+
+// templateMarker is created in the template once base-devel is installed,
+// so that a template that failed to install isn't used.
+const templateMarker = ".alpmbuild-template"
+
+// idRange is a range of subordinate IDs of the user, from /etc/subuid or
+// /etc/subgid.
+type idRange struct {
+	Start string
+	Count string
+}
+
+// subordinateIDs returns the first range of subordinate IDs in path that
+// belongs to the user, who is named by their name or ID.
+func subordinateIDs(path, name, id string) (idRange, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return idRange{}, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) == 3 && (fields[0] == name || fields[0] == id) {
+			return idRange{fields[1], fields[2]}, true
+		}
+	}
+	return idRange{}, false
+}
+
+// asNamespaceRoot makes cmd run as root in a user namespace that only maps
+// root to the user, like unshare --map-root-user. flags adds more
+// namespaces.
+func asNamespaceRoot(cmd *exec.Cmd, flags uintptr) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | flags,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+	}
+}
+
+// subordinateRanges returns the subordinate user and group IDs of the
+// user, if they have both and can map them.
+func subordinateRanges() (uids, gids idRange, ok bool) {
+	uid := strconv.Itoa(os.Getuid())
+	name := uid
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	uids, hasUIDs := subordinateIDs("/etc/subuid", name, uid)
+	gids, hasGIDs := subordinateIDs("/etc/subgid", name, uid)
+	_, uidmapErr := exec.LookPath("newuidmap")
+	_, gidmapErr := exec.LookPath("newgidmap")
+	return uids, gids, hasUIDs && hasGIDs && uidmapErr == nil && gidmapErr == nil
+}
+
+// startAsNamespaceRoot starts cmd as root in a user namespace that maps
+// root to the user, like unshare --map-root-user. flags adds more
+// namespaces. If the user has subordinate IDs, they are mapped to the
+// other users and groups with newuidmap and newgidmap, like podman maps
+// them, so that files can belong to them; otherwise only root is mapped.
+func startAsNamespaceRoot(cmd *exec.Cmd, flags uintptr) error {
+	uid, gid := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())
+	uids, gids, ok := subordinateRanges()
+	if !ok {
+		asNamespaceRoot(cmd, flags)
+		return cmd.Start()
+	}
+
+	// The IDs can only be mapped once the namespace exists, so the command
+	// waits for a line on a pipe before it runs.
+	shell, err := exec.LookPath("sh")
+	if err != nil {
+		return err
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, reader)
+	wait := fmt.Sprintf(`read -r _ <&%d && exec "$@" %d<&-`, fd, fd)
+	cmd.Args = append([]string{"sh", "-c", wait, "sh", cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = shell
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWUSER | flags}
+	err = cmd.Start()
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	pid := strconv.Itoa(cmd.Process.Pid)
+	output, err := exec.Command("newuidmap", pid, "0", uid, "1", "1", uids.Start, uids.Count).CombinedOutput()
+	if err == nil {
+		output, err = exec.Command("newgidmap", pid, "0", gid, "1", "1", gids.Start, gids.Count).CombinedOutput()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("could not map the IDs of the user namespace: %s", strings.TrimSpace(string(output)))
+	}
+	_, err = writer.Write([]byte("\n"))
+	return err
+}
+
+// run runs a command on the chroots as root. Users run it in a user
+// namespace, as the chroots have files that belong to other users.
+func (chroot *cleanChroot) run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	var err error
+	if os.Getuid() == 0 {
+		err = cmd.Start()
+	} else {
+		err = startAsNamespaceRoot(cmd, syscall.CLONE_NEWNS)
+	}
+	if err == nil {
+		err = cmd.Wait()
+	}
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %s", name, strings.Join(args, " "), err.Error())
+	}
+	return nil
+}
+
+// isSubvolume reports whether dir is a btrfs subvolume, which can be
+// snapshotted instead of copied.
+func isSubvolume(dir string) bool {
+	return exec.Command("btrfs", "subvolume", "show", dir).Run() == nil
+}
+
+// pacman runs pacman on the root of a chroot. Packages are cached in the
+// cache directory, as the system's cache isn't writable.
+func (chroot *cleanChroot) pacman(root string, args ...string) error {
+	cache := filepath.Join(directories.Cache, "pacman")
+	err := os.MkdirAll(cache, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(root, "var/lib/pacman"), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return chroot.run("pacman", append([]string{
+		"--root", root,
+		"--dbpath", filepath.Join(root, "var/lib/pacman"),
+		"--cachedir", cache,
+		"--noconfirm",
+	}, args...)...)
+}
+
+// setupTemplate creates the template root, if it doesn't exist yet.
+func (chroot *cleanChroot) setupTemplate() error {
+	if _, err := os.Stat(filepath.Join(chroot.Template, templateMarker)); err == nil {
+		return nil
+	}
+	if _, _, ok := subordinateRanges(); os.Getuid() != 0 && !ok {
+		return fmt.Errorf(
+			"building in a clean chroot needs subordinate IDs in /etc/subuid and /etc/subgid, and %s and %s",
+			highlight("newuidmap"), highlight("newgidmap"),
+		)
+	}
+	outputStatus("Creating the clean chroot template in " + highlight(chroot.Template) + "...")
+	chroot.run("rm", "-rf", chroot.Template)
+	err := os.MkdirAll(filepath.Dir(chroot.Template), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// A template on btrfs is made a subvolume, so that builds can get
+	// snapshots of it instead of copies.
+	if exec.Command("btrfs", "subvolume", "create", chroot.Template).Run() != nil {
+		err = os.Mkdir(chroot.Template, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+	err = chroot.pacman(chroot.Template, "-Sy", "base-devel")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(chroot.Template, templateMarker), nil, 0644)
+}
+
+// setupCleanChroot gives the build tree its clean chroot, with the given
+// packages installed. A build tree that is resumed keeps its chroot.
+func setupCleanChroot(tree *buildTree, packages []string) (*cleanChroot, error) {
+	chroot := &cleanChroot{
+		Template: filepath.Join(directories.Chroot, "root"),
+		Root:     filepath.Join(directories.Chroot, tree.ID),
+	}
+	if _, err := os.Stat(chroot.Root); err == nil {
+		return chroot, nil
+	}
+	err := chroot.setupTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	outputStatus("Setting up a clean chroot for build tree " + highlight(tree.ID) + "...")
+	if isSubvolume(chroot.Template) {
+		err = chroot.run("btrfs", "subvolume", "snapshot", chroot.Template, chroot.Root)
+	} else {
+		err = chroot.run("cp", "-a", "--reflink=auto", chroot.Template, chroot.Root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Like makechrootpkg, the chroot is brought up to date first, so that
+	// the packages aren't resolved against the sync databases the template
+	// was created with.
+	if len(packages) > 0 {
+		outputStatus("Installing " + highlight(strings.Join(packages, " ")) + " into the clean chroot...")
+	} else {
+		outputStatus("Updating the clean chroot...")
+	}
+	err = chroot.pacman(chroot.Root, append([]string{"-Syu", "--needed", "--asdeps"}, packages...)...)
+	if err != nil {
+		chroot.remove()
+		return nil, err
+	}
+	return chroot, nil
+}
+
+// command returns the command running the script at path in the chroot,
+// with the environment env. The directories of the build tree are mounted
+// at the same place inside the chroot, so the paths in the script work
+// there as well.
+func (chroot *cleanChroot) command(tree *buildTree, path string, env []string) *exec.Cmd {
+	root := shellQuote(chroot.Root)
+	lines := []string{
+		"set -e",
+		"mount -t proc proc " + root + "/proc",
+		"mount --rbind /dev " + root + "/dev",
+		"mount -t tmpfs tmpfs " + root + "/tmp",
+	}
+	for _, dir := range []string{directories.Sources, directories.Build, directories.BuildRoot, directories.Subpackages, tree.Record} {
+		lines = append(lines,
+			"mkdir -p "+shellQuote(dir)+" "+root+shellQuote(dir),
+			"mount --rbind "+shellQuote(dir)+" "+root+shellQuote(dir),
+		)
+	}
+	command := []string{"exec", "chroot", root, "/usr/bin/env", "-i"}
+	for _, variable := range env {
+		command = append(command, shellQuote(variable))
+	}
+	command = append(command, "PATH="+chrootPath, "HOME=/root", "bash", shellQuote(path))
+	lines = append(lines, strings.Join(command, " "))
+
+	return exec.Command("bash", "-c", strings.Join(lines, "\n"))
+}
+
+// start starts a command returned by command, in new namespaces.
+func (chroot *cleanChroot) start(cmd *exec.Cmd) error {
+	flags := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWPID)
+	if !*chrootNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+	return startAsNamespaceRoot(cmd, flags)
+}
+
+// remove deletes the chroot of a build.
+func (chroot *cleanChroot) remove() error {
+	if isSubvolume(chroot.Root) {
+		return chroot.run("btrfs", "subvolume", "delete", chroot.Root)
+	}
+	return chroot.run("rm", "-rf", chroot.Root)
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/appadeia/alpmbuild/lib/libalpm"
 	"github.com/appadeia/alpmbuild/lib/librpm"
 )
 
@@ -36,9 +37,16 @@ var generateSourcePackage *bool
 var buildFile *string
 var startPWD string
 var compressionType *string
-var fakeroot *bool
 var ignoreDeps *bool
-var initialWorking string
+var downloadTimeout *time.Duration
+var downloadRetries *int
+var downloadJobs *int
+var offline *bool
+var sourceBundle *string
+var keepBuildTree *bool
+var buildTreeID *string
+var cleanChrootBuild *bool
+var chrootNetwork *bool
 
 type arrayFlag []string
 
@@ -61,8 +69,24 @@ func Enter() {
 	generateSourcePackage = flag.Bool("generateSourcePackage", true, "Generate a source package")
 	compressionType = flag.String("compression", "zstd", "The compression type to use. Default is zstd. Choose from: gz, xz, bz2, or zstd.")
 	ignoreDeps = flag.Bool("ignoreDeps", false, "Ignore dependencies.")
-	fakeroot = flag.Bool("fakeroot", false, "Internal flag. Do not set.")
-	initialWorking, _ = os.Getwd()
+	downloadTimeout = flag.Duration("downloadTimeout", 30*time.Second, "How long to wait for a server to connect or send data before giving up.")
+	downloadRetries = flag.Int("downloadRetries", 3, "How many times to retry a failed download before trying mirrors.")
+	downloadJobs = flag.Int("downloadJobs", 4, "How many sources to download and verify at the same time.")
+	offline = flag.Bool("offline", false, "Never download sources; use the source cache and bundle only.")
+	sourceBundle = flag.String("bundle", "", "A directory of sources gathered with alpmbuild fetch.")
+	cleanChrootBuild = flag.Bool("clean-chroot", false, "Build in a clean chroot with only base-devel and the package's dependencies installed.")
+	chrootNetwork = flag.Bool("network", false, "Let builds in a clean chroot access the network.")
+	defineConfigFlags()
+	defineDependencyFlags()
+	keepBuildTree = flag.Bool("keep", false, "Keep the build tree after building instead of removing it.")
+	buildTreeID = flag.String("buildTree", "", "The build tree to resume with -short-circuit. Default is the newest one of the specfile.")
+
+	var macros arrayFlag
+
+	// Flags that mimic behaviour of rpmbuild
+	defineStepFlags()
+	flag.Var(&macros, "D", "Define a macro with MACRO EXPR")
+	flag.Var(&macros, "define", "Define a macro with MACRO EXPR")
 
 	// This is an easter egg.
 	if strings.Contains(strings.Join(os.Args, " "), "hit a ghost") {
@@ -80,12 +104,28 @@ func Enter() {
 
 	flag.Parse()
 
-	var macros arrayFlag
+	loadConfig()
+	directories = loadDirectories()
+	if root, _ := setting("rootdir", ""); root != "" {
+		libalpm.RootDir = root
+	}
+	if dbpath, _ := setting("dbpath", ""); dbpath != "" {
+		libalpm.DBPath = dbpath
+	}
 
-	// Flags that mimic behaviour of rpmbuild
-	ba := flag.String("ba", "", "Copies rpmbuild -ba's behaviour")
-	flag.Var(&macros, "D", "Define a macro with MACRO EXPR")
-	flag.Var(&macros, "define", "Define a macro with MACRO EXPR")
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "cache":
+			cacheCommand(flag.Args()[1:])
+			return
+		case "updsums":
+			updsumsCommand(flag.Args()[1:])
+			return
+		case "fetch":
+			fetchCommand(flag.Args()[1:])
+			return
+		}
+	}
 
 	if _, ok := CompressionTypes[*compressionType]; !ok {
 		outputError(*compressionType + " is not a valid compression method.")
@@ -97,9 +137,10 @@ func Enter() {
 		outputError("There was an error getting the current working directory:\n\t" + err.Error())
 	}
 
-	if *ba != "" {
-		*buildFile = *ba
-		*generateSourcePackage = true
+	var specPath string
+	plan, specPath = loadBuildPlan()
+	if specPath != "" {
+		*buildFile = specPath
 	}
 
 	for _, macro := range macros {
@@ -0,0 +1,250 @@
+package lib
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Settings can be given as a flag, an ALPMBUILD_ environment variable or a
+// line of the configuration file, which looks like this:
+//
+//	# Build in the CI workspace
+//	topdir = /srv/ci/workspace
+//	cachedir = ~/.cache/alpmbuild
+//	# Don't run %check unless asked to with -check
+//	check = false
+//	# Let builds see these variables of alpmbuild's environment
+//	keepenv = CCACHE_DIR DISTCC_HOSTS
+//	# Look packages up in the databases of another pacman root
+//	rootdir = /srv/ci/root
+//	# Install missing dependencies with doas
+//	elevate = doas
+//	# Translate dependency names with another file than depnames.conf
+//	depnames = ~/specs/depnames.conf
+//
+// Flags take precedence over the environment, which takes precedence over
+// the configuration file.
+
+// configKeys are the settings the configuration file understands.
+var configKeys = []string{"topdir", "check", "keepenv", "makepkgconf", "rootdir", "dbpath", "elevate", "depnames"}
+
+var config = map[string]string{}
+var configFile *string
+var topDirectory *string
+
+// buildDirectories are the directories alpmbuild works in. Like rpmbuild's
+// %_topdir, they all default to subdirectories of one directory, which is
+// ~/alpmbuild unless configured otherwise.
+type buildDirectories struct {
+	Top string
+	// Sources holds local sources (%{_sourcedir}).
+	Sources string
+	// Build is where sources are unpacked and built (%{_builddir}).
+	Build string
+	// BuildRoot is where the package is installed to (%{buildroot}).
+	BuildRoot string
+	// Subpackages holds the package roots of subpackages.
+	Subpackages string
+	// SourcePackages is where source packages are put together.
+	SourcePackages string
+	// Output receives finished packages.
+	Output string
+	// Cache holds downloaded sources.
+	Cache string
+	// Chroot holds the clean chroot template and the chroots of builds.
+	Chroot string
+}
+
+var directories buildDirectories
+
+// directorySettings are the directories that can be moved out of the
+// topdir, along with where they live in it by default.
+var directorySettings = []struct {
+	Key     string
+	Field   string
+	Default string
+	Usage   string
+}{
+	{"sourcedir", "Sources", "sources", "Where local sources are looked for."},
+	{"builddir", "Build", "buildroot", "Where sources are unpacked and built."},
+	{"buildroot", "BuildRoot", "package", "Where the package is installed to before it is compressed."},
+	{"outputdir", "Output", "packages", "Where finished packages are written to."},
+	{"cachedir", "Cache", "cache", "Where downloaded sources are cached."},
+	{"chrootdir", "Chroot", "chroot", "Where clean chroots are kept."},
+}
+
+var directoryFlags = map[string]*string{}
+
+// defineConfigFlags defines the flags for the configuration file and the
+// build directories.
+func defineConfigFlags() {
+	configFile = flag.String("config", "", "The configuration file to use instead of ~/.config/alpmbuild/alpmbuild.conf.")
+	topDirectory = flag.String("topdir", "", "The directory to build in. Default is ~/alpmbuild.")
+	for _, setting := range directorySettings {
+		configKeys = append(configKeys, setting.Key)
+		directoryFlags[setting.Key] = flag.String(setting.Key, "", setting.Usage+" Default is <topdir>/"+setting.Default+".")
+	}
+}
+
+func defaultConfigPath() string {
+	if path := os.Getenv("ALPMBUILD_CONFIG"); path != "" {
+		return path
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "alpmbuild/alpmbuild.conf")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config/alpmbuild/alpmbuild.conf")
+}
+
+// readConfig reads a configuration file. A file that doesn't exist is the
+// same as an empty one.
+func readConfig(path string) (map[string]string, error) {
+	values := map[string]string{}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("line %d of %s should look like %s", lineNumber, path, highlight("key = value"))
+		}
+		key := strings.TrimSpace(split[0])
+		value := strings.TrimSpace(split[1])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// loadConfig reads the configuration file into config.
+func loadConfig() {
+	path := *configFile
+	if path == "" {
+		path = defaultConfigPath()
+	}
+	if path == "" {
+		return
+	}
+	values, err := readConfig(path)
+	if err != nil {
+		outputError("Failed to read the configuration file:\n\t" + err.Error())
+	}
+	for key := range values {
+		known := false
+		for _, configKey := range configKeys {
+			known = known || key == configKey
+		}
+		if !known {
+			outputWarning(fmt.Sprintf(
+				"Unknown setting %s in %s. Did you mean to use %s?",
+				highlight(key), path, highlight(ClosestString(key, configKeys)),
+			))
+		}
+	}
+	config = values
+}
+
+// setting looks a setting up in the flags, the environment and the
+// configuration file, in that order. fromConfig tells whether the value
+// came from the configuration file.
+func setting(key string, flagValue string) (value string, fromConfig bool) {
+	if flagValue != "" {
+		return flagValue, false
+	}
+	if value := os.Getenv("ALPMBUILD_" + strings.ToUpper(key)); value != "" {
+		return value, false
+	}
+	return config[key], true
+}
+
+// expandHome replaces a leading ~ with the user's home directory.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		outputError("Could not get user's home directory.")
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
+
+// resolveDirectory makes a configured directory absolute. Directories from
+// the configuration file are relative to base, and those from flags or the
+// environment are relative to the working directory.
+func resolveDirectory(path string, fromConfig bool, base string) string {
+	path = expandHome(path)
+	if fromConfig && !filepath.IsAbs(path) {
+		path = filepath.Join(base, path)
+	}
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		outputError("Could not resolve the directory " + highlight(path) + ": " + err.Error())
+	}
+	return absolute
+}
+
+// loadDirectories works out where alpmbuild builds.
+func loadDirectories() buildDirectories {
+	var dirs buildDirectories
+
+	top, _ := setting("topdir", *topDirectory)
+	if top == "" {
+		top = "~/alpmbuild"
+	}
+	dirs.Top = resolveDirectory(top, false, "")
+	dirs.Subpackages = filepath.Join(dirs.Top, "subpackages")
+	dirs.SourcePackages = filepath.Join(dirs.Top, "sourcepackages")
+
+	value := reflect.ValueOf(&dirs).Elem()
+	for _, directory := range directorySettings {
+		path, fromConfig := setting(directory.Key, *directoryFlags[directory.Key])
+		if path == "" {
+			path, fromConfig = directory.Default, true
+		}
+		value.FieldByName(directory.Field).SetString(resolveDirectory(path, fromConfig, dirs.Top))
+	}
+	return dirs
+}
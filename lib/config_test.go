@@ -0,0 +1,44 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alpmbuild.conf")
+	err := ioutil.WriteFile(path, []byte("# Build in the workspace\ntopdir = /srv/workspace\n\ncachedir=\"~/cache dir\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["topdir"] != "/srv/workspace" || values["cachedir"] != "~/cache dir" || len(values) != 2 {
+		t.Errorf("unexpected settings %v", values)
+	}
+
+	if values, err := readConfig(filepath.Join(t.TempDir(), "missing.conf")); err != nil || len(values) != 0 {
+		t.Errorf("a missing file should be empty, got %v and %v", values, err)
+	}
+}
+
+func TestSettingPrecedence(t *testing.T) {
+	config = map[string]string{"builddir": "from-config"}
+	defer func() { config = map[string]string{} }()
+
+	if value, fromConfig := setting("builddir", ""); value != "from-config" || !fromConfig {
+		t.Errorf("expected the configuration file to be used, got %s", value)
+	}
+	os.Setenv("ALPMBUILD_BUILDDIR", "from-env")
+	defer os.Unsetenv("ALPMBUILD_BUILDDIR")
+	if value, fromConfig := setting("builddir", ""); value != "from-env" || fromConfig {
+		t.Errorf("expected the environment to win over the configuration file, got %s", value)
+	}
+	if value, _ := setting("builddir", "from-flag"); value != "from-flag" {
+		t.Errorf("expected the flag to win over the environment, got %s", value)
+	}
+}
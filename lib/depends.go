@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/appadeia/alpmbuild/lib/libalpm"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Dependencies can be written like rpm writes them, with spaces around the
+// operator and commas between them, or like pacman writes them:
+//
+//	Requires: pacman >= 5.2, glibc
+//	Requires: pacman>=5.2 glibc
+//
+// Either way, they are stored and written to .PKGINFO like pacman writes
+// them.
+
+// dependencyWords splits the value of a dependency field into words.
+// Parentheses of rich dependencies are words of their own, but those that
+// are part of a name, like in pkgconfig(gtk+-3.0), stay in it.
+func dependencyWords(value string) []string {
+	var words []string
+	word := ""
+	depth := 0
+	for _, r := range value {
+		switch {
+		case depth > 0:
+			word += string(r)
+			if r == '(' {
+				depth++
+			} else if r == ')' {
+				depth--
+			}
+		case r == '(' && word != "":
+			word += string(r)
+			depth++
+		case r == '(' || r == ')' || r == ',' || r == ' ' || r == '\t':
+			if word != "" {
+				words = append(words, word)
+				word = ""
+			}
+			if r == '(' || r == ')' {
+				words = append(words, string(r))
+			}
+		default:
+			word += string(r)
+		}
+	}
+	if word != "" {
+		words = append(words, word)
+	}
+	return words
+}
+
+// parseDependencyList parses the value of a dependency field, such as
+// Requires. field is the key of the field, such as requires:, which
+// decides what rich dependencies turn into.
+func parseDependencyList(value, field string) (dependencies []string, optional []optionalDependency, err error) {
+	words := dependencyWords(value)
+	for len(words) > 0 {
+		end := 0
+		for end < len(words) && words[end] != "(" && words[end] != ")" {
+			end++
+		}
+		simple, err := parseDependencies(words[:end])
+		if err != nil {
+			return nil, nil, err
+		}
+		if isRequirement(field) {
+			simple = translateDependencies(simple)
+		}
+		dependencies = append(dependencies, simple...)
+		words = words[end:]
+		if len(words) == 0 {
+			break
+		}
+
+		var rich *richDependency
+		rich, words, err = parseRichDependency(words)
+		if err != nil {
+			return nil, nil, err
+		}
+		translated, translatedOptional, err := rich.translate(field)
+		if err != nil {
+			return nil, nil, err
+		}
+		dependencies = append(dependencies, translated...)
+		optional = append(optional, translatedOptional...)
+	}
+	return dependencies, optional, nil
+}
+
+// parseDependencies parses dependencies that aren't rich dependencies.
+func parseDependencies(words []string) ([]string, error) {
+	// Operators that stand on their own, or start or end a word, join
+	// the words around them.
+	var joined []string
+	for _, word := range words {
+		if len(joined) > 0 {
+			last := joined[len(joined)-1]
+			if strings.IndexAny(word, "<>=") == 0 || strings.ContainsAny(last[len(last)-1:], "<>=") {
+				joined[len(joined)-1] += word
+				continue
+			}
+		}
+		joined = append(joined, word)
+	}
+
+	var dependencies []string
+	for _, word := range joined {
+		dep := libalpm.ParseDepend(word)
+		if dep.Name == "" {
+			return nil, fmt.Errorf("%s has no package name", highlight(word))
+		}
+		if dep.Mod != libalpm.DepModAny && (dep.Version == "" || strings.ContainsAny(dep.Version, "<>=")) {
+			return nil, fmt.Errorf("%s has no valid version", highlight(word))
+		}
+		dependencies = append(dependencies, dep.String())
+	}
+	return dependencies, nil
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/appadeia/alpmbuild/lib/libalpm"
+)
+
+// useTestDatabases points the pacman databases and the depnames file at
+// fixtures, so that dependencies don't depend on the machine the tests run
+// on. names are the user's dependency names.
+func useTestDatabases(t *testing.T, names map[string]string) {
+	savedDBPath, savedConfigFile := libalpm.DBPath, libalpm.ConfigFile
+	userDependencyNames.Do(func() {})
+	savedNames := userDependencyNames.names
+	t.Cleanup(func() {
+		libalpm.DBPath, libalpm.ConfigFile = savedDBPath, savedConfigFile
+		userDependencyNames.names = savedNames
+	})
+	libalpm.DBPath = filepath.Join("libalpm", "testdata", "sync")
+	libalpm.ConfigFile = filepath.Join("libalpm", "testdata", "sync", "pacman.conf")
+	userDependencyNames.names = names
+}
+
+func TestParseDependencyList(t *testing.T) {
+	useTestDatabases(t, nil)
+	for value, expected := range map[string][]string{
+		"pacman >= 5.2, glibc":       {"pacman>=5.2", "glibc"},
+		"pacman>=5.2 glibc":          {"pacman>=5.2", "glibc"},
+		"pacman >=5.2 glibc== 2.33":  {"pacman>=5.2", "glibc=2.33"},
+		"python3 < 3.10,python3>3.8": {"python3<3.10", "python3>3.8"},
+		"bash":                       {"bash"},
+	} {
+		dependencies, _, err := parseDependencyList(value, "requires:")
+		if err != nil || !reflect.DeepEqual(dependencies, expected) {
+			t.Errorf("parseDependencyList(%q) = %q, %v, expected %q", value, dependencies, err, expected)
+		}
+	}
+	for _, value := range []string{"pacman >=", ">= 5.2", "pacman >= >= 5.2"} {
+		if dependencies, _, err := parseDependencyList(value, "requires:"); err == nil {
+			t.Errorf("parseDependencyList(%q) = %q, expected an error", value, dependencies)
+		}
+	}
+}
+
+func TestRichDependencies(t *testing.T) {
+	useTestDatabases(t, nil)
+	for value, expected := range map[string]struct {
+		dependencies []string
+		optional     []optionalDependency
+	}{
+		"(foo or bar) baz": {
+			[]string{"foo", "baz"},
+			[]optionalDependency{{"bar", "alternative to foo"}},
+		},
+		"(foo >= 1.0 and (bar with libbar.so=1-64))": {
+			[]string{"foo>=1.0", "bar", "libbar.so=1-64"},
+			nil,
+		},
+		"(bar or gtk3)": {
+			[]string{"bar"},
+			[]optionalDependency{{"gtk3", "alternative to bar"}},
+		},
+		"(foo-gtk if gtk3)": {
+			nil,
+			[]optionalDependency{{"foo-gtk", "for use with gtk3"}},
+		},
+	} {
+		dependencies, optional, err := parseDependencyList(value, "requires:")
+		if err != nil || !reflect.DeepEqual(dependencies, expected.dependencies) || !reflect.DeepEqual(optional, expected.optional) {
+			t.Errorf("parseDependencyList(%q) = %q, %q, %v", value, dependencies, optional, err)
+		}
+	}
+
+	if dependencies, _, err := parseDependencyList("(foo or bar)", "buildrequires:"); err != nil || !reflect.DeepEqual(dependencies, []string{"foo"}) {
+		t.Errorf("unexpected build dependencies %q, %v", dependencies, err)
+	}
+	for value, construct := range map[string]string{
+		"(foo unless bar)":      "unless",
+		"(foo if bar else baz)": "if else",
+		"(foo without bar)":     "without",
+		"(foo or bar and baz)":  "can't be mixed",
+		"(foo or bar":           "unmatched",
+	} {
+		if _, _, err := parseDependencyList(value, "requires:"); err == nil || !strings.Contains(err.Error(), construct) {
+			t.Errorf("parseDependencyList(%q) failed with %v, expected it to name %s", value, err, construct)
+		}
+	}
+	if _, _, err := parseDependencyList("(foo or bar)", "provides:"); err == nil {
+		t.Errorf("a rich dependency was provided")
+	}
+}
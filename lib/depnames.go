@@ -0,0 +1,303 @@
+package lib
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/appadeia/alpmbuild/lib/libalpm"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Specfiles written for Fedora or openSUSE name their dependencies like
+// those distributions do, so requirements are translated to the names of
+// Arch packages while the specfile is parsed. Names are looked up in the
+// user's depnames file first, then in dependencyNames. Dependencies on
+// files, such as pkgconfig(gtk+-3.0), perl(JSON) or /usr/bin/python3, are
+// resolved to the package that owns the file in the files databases, which
+// pacman -Fy downloads.
+//
+// The depnames file sits next to the configuration file unless the depnames
+// setting says otherwise, and looks like this:
+//
+//	# Names of the distribution = names of Arch packages
+//	libfoo-devel = foo
+//	qt5-qtwebengine-devel = qt5-webengine qt5-base
+//	# Nothing on Arch is needed for these
+//	foo-rpm-macros =
+
+// dependencyNames maps the names of Fedora and openSUSE packages to the
+// Arch packages that provide the same thing. Names that map to nothing are
+// packaging helpers that Arch has no use for.
+var dependencyNames = map[string][]string{
+	"gcc-c++":                 {"gcc"},
+	"gcc-gfortran":            {"gcc-fortran"},
+	"libstdc++-devel":         {"gcc-libs"},
+	"glibc-devel":             {"glibc"},
+	"glibc-static":            {"glibc"},
+	"kernel-headers":          {"linux-api-headers"},
+	"pkgconfig":               {"pkgconf"},
+	"pkg-config":              {"pkgconf"},
+	"pkgconf-pkg-config":      {"pkgconf"},
+	"ninja-build":             {"ninja"},
+	"git-core":                {"git"},
+	"golang":                  {"go"},
+	"cargo":                   {"rust"},
+	"java-devel":              {"java-environment"},
+	"java-headless":           {"java-runtime-headless"},
+	"perl-interpreter":        {"perl"},
+	"perl-devel":              {"perl"},
+	"python3-devel":           {"python"},
+	"python3-libs":            {"python"},
+	"ruby-devel":              {"ruby"},
+	"libappstream-glib":       {"appstream-glib"},
+	"glib2-devel":             {"glib2"},
+	"gtk2-devel":              {"gtk2"},
+	"gtk3-devel":              {"gtk3"},
+	"gtk4-devel":              {"gtk4"},
+	"qt5-qtbase-devel":        {"qt5-base"},
+	"qt5-qtdeclarative-devel": {"qt5-declarative"},
+	"qt5-qtsvg-devel":         {"qt5-svg"},
+	"qt6-qtbase-devel":        {"qt6-base"},
+	"openssl-devel":           {"openssl"},
+	"libopenssl-devel":        {"openssl"},
+	"zlib-devel":              {"zlib"},
+	"bzip2-devel":             {"bzip2"},
+	"xz-devel":                {"xz"},
+	"libzstd-devel":           {"zstd"},
+	"libcurl-devel":           {"curl"},
+	"ncurses-devel":           {"ncurses"},
+	"readline-devel":          {"readline"},
+	"libxml2-devel":           {"libxml2"},
+	"sqlite-devel":            {"sqlite"},
+	"libffi-devel":            {"libffi"},
+	"systemd-devel":           {"systemd"},
+	"libuuid-devel":           {"util-linux-libs"},
+	"libblkid-devel":          {"util-linux-libs"},
+	"libX11-devel":            {"libx11"},
+	"libXext-devel":           {"libxext"},
+	"libXrandr-devel":         {"libxrandr"},
+	"mesa-libGL-devel":        {"mesa"},
+	"mesa-libEGL-devel":       {"mesa"},
+	"SDL2-devel":              {"sdl2"},
+	"redhat-rpm-config":       {},
+	"systemd-rpm-macros":      {},
+	"go-rpm-macros":           {},
+	"cargo-rpm-macros":        {},
+	"rust-packaging":          {},
+	"perl-generators":         {},
+	"python3-rpm-macros":      {},
+	"update-desktop-files":    {},
+	"fdupes":                  {},
+}
+
+var userDependencyNames struct {
+	sync.Once
+	names map[string]string
+}
+
+// depnamesPath returns the path of the user's depnames file.
+func depnamesPath() string {
+	path, fromConfig := setting("depnames", "")
+	configPath := defaultConfigPath()
+	if configFile != nil && *configFile != "" {
+		configPath = *configFile
+	}
+	if path == "" {
+		if configPath == "" {
+			return ""
+		}
+		return filepath.Join(filepath.Dir(configPath), "depnames.conf")
+	}
+	return resolveDirectory(path, fromConfig, filepath.Dir(configPath))
+}
+
+// userDependencyName looks name up in the user's depnames file.
+func userDependencyName(name string) ([]string, bool) {
+	userDependencyNames.Do(func() {
+		path := depnamesPath()
+		if path == "" {
+			return
+		}
+		names, err := readConfig(path)
+		if err != nil {
+			outputError("Failed to read the dependency names:\n\t" + err.Error())
+		}
+		userDependencyNames.names = names
+	})
+	names, ok := userDependencyNames.names[name]
+	return strings.Fields(names), ok
+}
+
+// fileDependencyMatcher returns what a file owned by the dependency on a
+// file, such as pkgconfig(gtk+-3.0), looks like in the files databases.
+// Dependencies that aren't on files get nothing.
+func fileDependencyMatcher(name string) (matches func(file string) bool, ok bool) {
+	module := func(kind string) (string, bool) {
+		if strings.HasPrefix(name, kind+"(") && strings.HasSuffix(name, ")") {
+			return name[len(kind)+1 : len(name)-1], true
+		}
+		return "", false
+	}
+	if module, ok := module("pkgconfig"); ok {
+		return func(file string) bool {
+			return file == "usr/lib/pkgconfig/"+module+".pc" || file == "usr/share/pkgconfig/"+module+".pc"
+		}, true
+	}
+	if module, ok := module("perl"); ok {
+		// Perl modules are in vendor_perl, core_perl or site_perl.
+		suffix := "_perl/" + strings.Replace(module, "::", "/", -1) + ".pm"
+		return func(file string) bool {
+			return strings.HasPrefix(file, "usr/") && strings.HasSuffix(file, suffix)
+		}, true
+	}
+	if strings.HasPrefix(name, "/") {
+		// /bin, /sbin and /lib are links into /usr on Arch, and /usr/sbin is
+		// a link to /usr/bin.
+		path := strings.TrimPrefix(filepath.Clean(name), "/")
+		candidates := []string{path}
+		for _, prefix := range []string{"bin/", "sbin/", "usr/sbin/", "lib/", "lib64/", "usr/lib64/"} {
+			if strings.HasPrefix(path, prefix) {
+				moved := strings.TrimPrefix(path, prefix)
+				if strings.Contains(prefix, "bin") {
+					candidates = append(candidates, "usr/bin/"+moved)
+				} else {
+					candidates = append(candidates, "usr/lib/"+moved)
+				}
+			}
+		}
+		return func(file string) bool {
+			for _, candidate := range candidates {
+				if file == candidate {
+					return true
+				}
+			}
+			return false
+		}, true
+	}
+	return nil, false
+}
+
+// genericDependencyName guesses the Arch name of a package by how Fedora
+// and openSUSE name them, such as python3-requests for python-requests and
+// libfoo-devel for libfoo. Guesses are only taken if the repositories have
+// them.
+func genericDependencyName(name string) (string, bool) {
+	var guesses []string
+	if strings.HasPrefix(name, "python3-") {
+		guesses = append(guesses, "python-"+strings.TrimPrefix(name, "python3-"))
+	}
+	if strings.HasPrefix(name, "python3dist(") && strings.HasSuffix(name, ")") {
+		guesses = append(guesses, "python-"+strings.ToLower(name[len("python3dist("):len(name)-1]))
+	}
+	if strings.HasPrefix(name, "perl-") {
+		guesses = append(guesses, strings.ToLower(name))
+	}
+	for _, suffix := range []string{"-devel", "-headers"} {
+		if strings.HasSuffix(name, suffix) {
+			trimmed := strings.TrimSuffix(name, suffix)
+			guesses = append(guesses, trimmed, strings.ToLower(trimmed))
+		}
+	}
+	for _, guess := range guesses {
+		if _, ok := libalpm.SyncSatisfier(guess); ok {
+			return guess, true
+		}
+	}
+	return "", false
+}
+
+// warnedDependencies are the dependencies translateDependency has warned
+// about, so that dependencies of several packages are only warned about
+// once.
+var warnedDependencies = map[string]bool{}
+
+func warnDependency(dependency, message string) {
+	if !warnedDependencies[dependency] {
+		outputWarning(message)
+		warnedDependencies[dependency] = true
+	}
+}
+
+// translateDependency translates a dependency to the Arch packages that
+// satisfy it. Dependencies with nothing to translate them by are left
+// alone. Dependencies on files are left alone with -ignoreDeps, as looking
+// them up needs the files databases.
+func translateDependency(dependency string) []string {
+	dep := libalpm.ParseDepend(dependency)
+	rename := func(names []string) []string {
+		translated := []string{}
+		for _, name := range names {
+			translated = append(translated, libalpm.Depend{Name: name, Mod: dep.Mod, Version: dep.Version}.String())
+		}
+		return translated
+	}
+
+	if names, ok := userDependencyName(dep.Name); ok {
+		return rename(names)
+	}
+	if names, ok := dependencyNames[dep.Name]; ok {
+		return rename(names)
+	}
+	if matches, ok := fileDependencyMatcher(dep.Name); ok {
+		if ignoreDeps != nil && *ignoreDeps {
+			return []string{dependency}
+		}
+		dbs, err := libalpm.FilesDatabases()
+		if err != nil {
+			warnDependency(dependency, "Could not read the files databases to translate "+highlight(dep.Name)+": "+err.Error())
+			return []string{dependency}
+		}
+		owner, _, ok := libalpm.FindFileOwner(dbs, matches)
+		if !ok {
+			warnDependency(dependency, fmt.Sprintf(
+				"No package in the files databases has %s, so it is left as it is. Run %s to update them, or add it to %s.",
+				highlight(dep.Name), highlight("pacman -Fy"), highlight(depnamesPath()),
+			))
+			return []string{dependency}
+		}
+		// The version is the version of the file, such as the version of a
+		// pkg-config module, which isn't always the version of the package.
+		if dep.Mod != libalpm.DepModAny {
+			warnDependency(dependency, fmt.Sprintf(
+				"%s is translated to %s without its version, as the version of %s isn't the version of %s.",
+				highlight(dependency), highlight(owner.Name), highlight(dep.Name), highlight(owner.Name),
+			))
+		}
+		return []string{owner.Name}
+	}
+	if _, ok := libalpm.SyncSatisfier(dependency); !ok {
+		if name, ok := genericDependencyName(dep.Name); ok {
+			return rename([]string{name})
+		}
+	}
+	return []string{dependency}
+}
+
+// translateDependencies translates each of the dependencies.
+func translateDependencies(dependencies []string) []string {
+	var translated []string
+	for _, dependency := range dependencies {
+		translated = append(translated, translateDependency(dependency)...)
+	}
+	return translated
+}
@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTranslateDependencies(t *testing.T) {
+	useTestDatabases(t, map[string]string{"gcc-c++": "clang", "foo-macros": ""})
+
+	for value, expected := range map[string][]string{
+		"gcc-c++, glibc-devel >= 2.33":    {"clang", "glibc>=2.33"},
+		"foo-macros redhat-rpm-config":    nil,
+		"pkgconfig(gtk+-3.0) >= 3.24":     {"gtk3"},
+		"pkgconfig(python3)":              {"python"},
+		"/bin/sh, /usr/bin/python3":       {"bash", "python"},
+		"perl(JSON) >= 4.0":               {"perl-json"},
+		"python3-devel >= 3.9 bash-devel": {"python>=3.9", "bash"},
+		"python3-requests":                {"python3-requests"},
+		"(pkgconfig(gtk+-3.0) or foo)":    {"gtk3"},
+	} {
+		dependencies, _, err := parseDependencyList(value, "buildrequires:")
+		if err != nil || !reflect.DeepEqual(dependencies, expected) {
+			t.Errorf("parseDependencyList(%q) = %q, %v, expected %q", value, dependencies, err, expected)
+		}
+	}
+
+	if dependencies, _, err := parseDependencyList("pkgconfig(nothing) >= 1.2", "requires:"); err != nil || !reflect.DeepEqual(dependencies, []string{"pkgconfig(nothing)>=1.2"}) {
+		t.Errorf("an unowned file was translated to %q, %v", dependencies, err)
+	}
+	savedIgnoreDeps := ignoreDeps
+	defer func() { ignoreDeps = savedIgnoreDeps }()
+	ignore := true
+	ignoreDeps = &ignore
+	if dependencies, _, err := parseDependencyList("pkgconfig(gtk+-3.0)", "requires:"); err != nil || !reflect.DeepEqual(dependencies, []string{"pkgconfig(gtk+-3.0)"}) {
+		t.Errorf("a file was looked up with -ignoreDeps, and translated to %q, %v", dependencies, err)
+	}
+	if dependencies, _, err := parseDependencyList("gcc-c++", "provides:"); err != nil || !reflect.DeepEqual(dependencies, []string{"gcc-c++"}) {
+		t.Errorf("provides were translated to %q, %v", dependencies, err)
+	}
+}
+
+func TestParseUntranslatedDependency(t *testing.T) {
+	useTestDatabases(t, nil)
+	savedIgnoreDeps := ignoreDeps
+	defer func() { ignoreDeps = savedIgnoreDeps }()
+	ignore := false
+	ignoreDeps = &ignore
+
+	pkg := ParsePackage(`Name: hello
+Version: 1.0
+Release: 1
+Summary: Says hello
+License: MIT
+BuildRequires: pkgconfig(nothing)
+`)
+	if !reflect.DeepEqual(pkg.BuildRequires, []string{"pkgconfig(nothing)"}) {
+		t.Errorf("unexpected build dependencies %q", pkg.BuildRequires)
+	}
+}
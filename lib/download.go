@@ -0,0 +1,305 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+const partialSuffix = ".part"
+
+// downloader fetches files over HTTP. Interrupted downloads are kept next
+// to the destination and resumed with Range requests, failed attempts are
+// retried with exponential backoff, and the destination only appears once
+// the whole file has arrived.
+type downloader struct {
+	// Timeout limits connecting, waiting for response headers, and how long
+	// a transfer may stall without receiving any data.
+	Timeout time.Duration
+	// Retries is how many times a URL is tried again after the first attempt.
+	Retries int
+	// Backoff is the delay before the first retry; it doubles every time.
+	Backoff time.Duration
+	// Progress is called as data arrives. total is -1 if it isn't known.
+	Progress func(url string, done, total int64)
+	// Warn is told when a URL fails and a mirror is tried instead.
+	Warn func(message string)
+}
+
+// statusError is returned when a server answers with something other than
+// the file we asked for.
+type statusError struct {
+	URL    string
+	Status string
+	Code   int
+}
+
+func (err *statusError) Error() string {
+	return fmt.Sprintf("%s returned %s", err.URL, err.Status)
+}
+
+// localError is returned when a download fails on this side rather than
+// on the server's, such as when the file can't be written.
+type localError struct {
+	URL string
+	Err error
+}
+
+func (err *localError) Error() string {
+	return fmt.Sprintf("could not download %s: %s", err.URL, err.Err.Error())
+}
+
+func (err *localError) Unwrap() error {
+	return err.Err
+}
+
+// retryable reports whether trying the same URL again might help.
+func retryable(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.Code >= 500 || status.Code == http.StatusTooManyRequests || status.Code == http.StatusRequestTimeout
+	}
+	var local *localError
+	return !errors.As(err, &local)
+}
+
+func newDownloader() downloader {
+	return downloader{
+		Timeout:  *downloadTimeout,
+		Retries:  *downloadRetries,
+		Backoff:  time.Second,
+		Progress: outputProgress,
+		Warn:     outputWarning,
+	}
+}
+
+func (d downloader) client() *http.Client {
+	dialer := &net.Dialer{Timeout: d.Timeout}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   d.Timeout,
+			ResponseHeaderTimeout: d.Timeout,
+		},
+	}
+}
+
+// download fetches the first of urls that works into dest. The remaining
+// URLs are mirrors, which are only tried once the ones before them have
+// failed.
+func (d downloader) download(dest string, urls ...string) error {
+	var failures []string
+	for index, url := range urls {
+		err := d.downloadWithRetries(dest, url)
+		if err == nil {
+			return nil
+		}
+		failures = append(failures, err.Error())
+		if index+1 < len(urls) && d.Warn != nil {
+			d.Warn(fmt.Sprintf("Failed to download %s, trying mirror %s...", highlight(url), highlight(urls[index+1])))
+		}
+	}
+	return errors.New(strings.Join(failures, "\n\t"))
+}
+
+func (d downloader) downloadWithRetries(dest, url string) error {
+	partial := dest + partialSuffix
+	client := d.client()
+	delay := d.Backoff
+
+	var err error
+	for attempt := 0; attempt <= d.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		err = d.attempt(client, partial, url)
+		if err == nil {
+			err = os.Rename(partial, dest)
+			if err != nil {
+				return &localError{URL: url, Err: err}
+			}
+			return nil
+		}
+		if !retryable(err) {
+			break
+		}
+	}
+	return err
+}
+
+// attempt makes a single request for url, appending to what partial
+// already holds if the server supports it.
+func (d downloader) attempt(client *http.Client, partial, url string) error {
+	var offset int64
+	if info, err := os.Stat(partial); err == nil {
+		offset = info.Size()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return &localError{URL: url, Err: err}
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			os.Remove(partial)
+			return fmt.Errorf("%s returned an unexpected range %q", url, resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusOK:
+		// Either this is a fresh download or the server ignored our Range
+		// header, so start from the beginning.
+		offset = 0
+		flags |= os.O_TRUNC
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// What we have doesn't fit the file on the server any more.
+		os.Remove(partial)
+		return fmt.Errorf("%s could not resume the download", url)
+	default:
+		return &statusError{URL: url, Status: resp.Status, Code: resp.StatusCode}
+	}
+
+	out, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return &localError{URL: url, Err: err}
+	}
+	defer out.Close()
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+
+	body := &stallReader{
+		reader:  resp.Body,
+		timeout: d.Timeout,
+		cancel:  cancel,
+	}
+	defer body.stop()
+
+	done := offset
+	buffer := make([]byte, 32*1024)
+	for {
+		n, readErr := body.Read(buffer)
+		if n > 0 {
+			if _, err := out.Write(buffer[:n]); err != nil {
+				return &localError{URL: url, Err: err}
+			}
+			done += int64(n)
+			if d.Progress != nil {
+				d.Progress(url, done, total)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			if atomic.LoadInt32(&body.stalled) != 0 {
+				return fmt.Errorf("%s stalled for more than %s", url, d.Timeout)
+			}
+			return readErr
+		}
+	}
+
+	if total >= 0 && done != total {
+		return fmt.Errorf("%s ended after %d of %d bytes", url, done, total)
+	}
+	return nil
+}
+
+// stallReader cancels a transfer if no data arrives for timeout.
+type stallReader struct {
+	reader  io.Reader
+	timeout time.Duration
+	cancel  func()
+	timer   *time.Timer
+	stalled int32
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	if r.timeout > 0 {
+		if r.timer == nil {
+			r.timer = time.AfterFunc(r.timeout, func() {
+				atomic.StoreInt32(&r.stalled, 1)
+				r.cancel()
+			})
+		} else {
+			r.timer.Reset(r.timeout)
+		}
+	}
+	return r.reader.Read(p)
+}
+
+func (r *stallReader) stop() {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
+
+var lastProgress time.Time
+
+// outputProgress shows how far along a download is on a single line that
+// keeps being rewritten. Nothing is shown if the output isn't a terminal.
+func outputProgress(url string, done, total int64) {
+	if !IsStdoutTty() {
+		return
+	}
+	finished := total >= 0 && done >= total
+	if !finished && time.Since(lastProgress) < 100*time.Millisecond {
+		return
+	}
+	lastProgress = time.Now()
+
+	status := humanSize(done)
+	if total > 0 {
+		status = fmt.Sprintf("%3d%% %s / %s", done*100/total, humanSize(done), humanSize(total))
+	}
+	print("\r\033[K    " + bold(path.Base(url)) + " " + status)
+	if finished {
+		println()
+	}
+}
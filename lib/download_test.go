@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testPayload = bytes.Repeat([]byte("alpmbuild source payload\n"), 4096)
+
+func testDownloader() downloader {
+	return downloader{
+		Timeout: time.Second,
+		Retries: 2,
+		Backoff: time.Millisecond,
+	}
+}
+
+func serveTestPayload(w http.ResponseWriter, r *http.Request) {
+	http.ServeContent(w, r, "payload.tar.gz", time.Unix(1, 0), bytes.NewReader(testPayload))
+}
+
+func checkDownloaded(t *testing.T, path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testPayload) {
+		t.Fatalf("downloaded %d bytes that don't match the %d byte payload", len(data), len(testPayload))
+	}
+	if _, err := os.Stat(path + partialSuffix); !os.IsNotExist(err) {
+		t.Errorf("partial download was left behind")
+	}
+}
+
+func TestDownload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(serveTestPayload))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "payload.tar.gz")
+	var progressed int64
+	d := testDownloader()
+	d.Progress = func(url string, done, total int64) {
+		if total != int64(len(testPayload)) {
+			t.Errorf("expected a total of %d, got %d", len(testPayload), total)
+		}
+		progressed = done
+	}
+	if err := d.download(dest, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	checkDownloaded(t, dest)
+	if progressed != int64(len(testPayload)) {
+		t.Errorf("progress stopped at %d bytes", progressed)
+	}
+}
+
+func TestDownloadNotFound(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "payload.tar.gz")
+	err := testDownloader().download(dest, server.URL)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected a 404 error, got %v", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("the error page was saved as the download")
+	}
+	if requests != 1 {
+		t.Errorf("a 404 should not be retried, but %d requests were made", requests)
+	}
+}
+
+func TestDownloadLocalError(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		serveTestPayload(w, r)
+	}))
+	defer server.Close()
+
+	// The directory the download would be saved in doesn't exist.
+	dest := filepath.Join(t.TempDir(), "missing", "payload.tar.gz")
+	err := testDownloader().download(dest, server.URL)
+	if err == nil || !strings.Contains(err.Error(), "no such file or directory") || strings.Contains(err.Error(), "returned") {
+		t.Fatalf("expected a local error, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("a local error should not be retried, but %d requests were made", requests)
+	}
+}
+
+func TestDownloadRetries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		serveTestPayload(w, r)
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "payload.tar.gz")
+	if err := testDownloader().download(dest, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	checkDownloaded(t, dest)
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		serveTestPayload(w, r)
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "payload.tar.gz")
+	half := len(testPayload) / 2
+	if err := ioutil.WriteFile(dest+partialSuffix, testPayload[:half], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := testDownloader().download(dest, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	checkDownloaded(t, dest)
+	if len(ranges) != 1 || ranges[0] != "bytes="+strconv.Itoa(half)+"-" {
+		t.Errorf("expected a single resumed request, got ranges %q", ranges)
+	}
+}
+
+func TestDownloadTruncatedIsResumed(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// Promise the whole file, then hang up halfway through.
+			w.Header().Set("Content-Length", strconv.Itoa(len(testPayload)))
+			w.Write(testPayload[:len(testPayload)/2])
+			return
+		}
+		serveTestPayload(w, r)
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "payload.tar.gz")
+	if err := testDownloader().download(dest, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	checkDownloaded(t, dest)
+}
+
+func TestDownloadMirror(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer broken.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(serveTestPayload))
+	defer mirror.Close()
+
+	var warned bool
+	d := testDownloader()
+	d.Warn = func(string) { warned = true }
+	dest := filepath.Join(t.TempDir(), "payload.tar.gz")
+	if err := d.download(dest, broken.URL, mirror.URL); err != nil {
+		t.Fatal(err)
+	}
+	checkDownloaded(t, dest)
+	if !warned {
+		t.Errorf("falling back to a mirror was not reported")
+	}
+}
+
+func TestDownloadStall(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(testPayload)))
+		w.Write(testPayload[:10])
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	d := testDownloader()
+	d.Timeout = 50 * time.Millisecond
+	d.Retries = 0
+	dest := filepath.Join(t.TempDir(), "payload.tar.gz")
+	err := d.download(dest, server.URL)
+	if err == nil || !strings.Contains(err.Error(), "stalled") {
+		t.Fatalf("expected the download to stall, got %v", err)
+	}
+}
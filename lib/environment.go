@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Sections don't inherit alpmbuild's environment. They get the variables
+// of keptEnvironment and the keepenv setting, and the compiler flags from
+// makepkg.conf, so that packages come out the same no matter who builds
+// them.
+
+// makepkgConfVariables are the settings of makepkg.conf alpmbuild reads.
+var makepkgConfVariables = []string{
+	"CARCH", "CHOST",
+	"CPPFLAGS", "CFLAGS", "CXXFLAGS", "LDFLAGS", "LTOFLAGS", "RUSTFLAGS", "MAKEFLAGS",
+	"DEBUG_CFLAGS", "DEBUG_CXXFLAGS", "DEBUG_RUSTFLAGS",
+	"OPTIONS", "STRIP_BINARIES", "STRIP_SHARED", "STRIP_STATIC", "PURGE_TARGETS", "MAN_DIRS",
+}
+
+// exportedMakepkgVariables are the settings of makepkg.conf that makepkg
+// exports to builds.
+var exportedMakepkgVariables = []string{
+	"CARCH", "CHOST",
+	"CPPFLAGS", "CFLAGS", "CXXFLAGS", "LDFLAGS", "RUSTFLAGS", "MAKEFLAGS",
+}
+
+// makepkgMacros are the macros set from makepkg.conf, like the ones of
+// rpm's redhat-rpm-config.
+var makepkgMacros = map[string]string{
+	"optflags":        "CFLAGS",
+	"build_cflags":    "CFLAGS",
+	"build_cxxflags":  "CXXFLAGS",
+	"build_ldflags":   "LDFLAGS",
+	"build_rustflags": "RUSTFLAGS",
+	"_smp_mflags":     "MAKEFLAGS",
+}
+
+// keptEnvironment are the variables sections get from alpmbuild's
+// environment.
+var keptEnvironment = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "TERM", "TMPDIR", "SOURCE_DATE_EPOCH",
+	"http_proxy", "https_proxy", "ftp_proxy", "no_proxy",
+	"HTTP_PROXY", "HTTPS_PROXY", "FTP_PROXY", "NO_PROXY",
+}
+
+var makepkgConf = map[string]string{}
+
+// makepkgConfPaths returns the makepkg.conf files to read, in the order
+// makepkg reads them.
+func makepkgConfPaths() []string {
+	system, _ := setting("makepkgconf", "")
+	if system == "" {
+		system = "/etc/makepkg.conf"
+	}
+	paths := []string{system}
+	fragments, _ := filepath.Glob(system + ".d/*.conf")
+	paths = append(paths, fragments...)
+
+	user := ""
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		user = filepath.Join(dir, "pacman/makepkg.conf")
+	} else if home, err := os.UserHomeDir(); err == nil {
+		user = filepath.Join(home, ".config/pacman/makepkg.conf")
+	}
+	if _, err := os.Stat(user); err != nil {
+		if home, err := os.UserHomeDir(); err == nil {
+			user = filepath.Join(home, ".makepkg.conf")
+		}
+	}
+	return append(paths, user)
+}
+
+// debugFlags are the flags added to the settings of makepkg.conf with the
+// debug option. The paths of sources are mapped to where the debug package
+// of pkgbase puts them.
+func debugFlags(pkgbase string) map[string]string {
+	sourceMap := directories.Build + "=" + debugSources(pkgbase)
+	return map[string]string{
+		"CFLAGS":    makepkgConf["DEBUG_CFLAGS"] + " -ffile-prefix-map=" + sourceMap,
+		"CXXFLAGS":  makepkgConf["DEBUG_CXXFLAGS"] + " -ffile-prefix-map=" + sourceMap,
+		"RUSTFLAGS": makepkgConf["DEBUG_RUSTFLAGS"] + " --remap-path-prefix=" + sourceMap,
+	}
+}
+
+// ltoFlags are the flags added to the settings of makepkg.conf with the lto
+// option.
+func ltoFlags() map[string]string {
+	flags := makepkgConf["LTOFLAGS"]
+	if flags == "" {
+		flags = "-flto"
+	}
+	return map[string]string{
+		"CFLAGS":   flags,
+		"CXXFLAGS": flags,
+		"LDFLAGS":  flags,
+	}
+}
+
+// makepkgSetting returns the value of a setting of makepkg.conf for
+// building pkgbase, with debugFlags added to it when the debug option is
+// on and ltoFlags when the lto option is, in the order makepkg adds them.
+func makepkgSetting(variable, pkgbase string) (string, bool) {
+	value, ok := makepkgConf[variable]
+	for _, extra := range []struct {
+		Enabled bool
+		Flags   map[string]string
+	}{
+		{debugEnabled(), debugFlags(pkgbase)},
+		{buildOption("lto", false), ltoFlags()},
+	} {
+		if flags, isFlags := extra.Flags[variable]; isFlags && extra.Enabled {
+			value, ok = strings.TrimSpace(value+" "+strings.TrimSpace(flags)), true
+		}
+	}
+	return value, ok
+}
+
+// readMakepkgConf reads the settings of makepkgConfVariables from the given
+// makepkg.conf files, later ones overriding earlier ones. makepkg.conf is a
+// shell script, so it's read by bash. Files that don't exist are skipped.
+func readMakepkgConf(paths []string) (map[string]string, error) {
+	var script []string
+	for _, path := range paths {
+		script = append(script, "if [ -r "+shellQuote(path)+" ]; then source "+shellQuote(path)+" || exit; fi")
+	}
+	script = append(script,
+		"for variable in "+strings.Join(makepkgConfVariables, " ")+"; do",
+		// OPTIONS is an array, which is read as its words.
+		`	declare -n value=$variable`,
+		`	if [ -n "${value+set}" ]; then printf '%s=%s\0' "$variable" "${value[*]}"; fi`,
+		`	unset -n value`,
+		"done",
+	)
+	cmd := exec.Command("bash", "--noprofile", "--norc", "-c", strings.Join(script, "\n"))
+	cmd.Env = []string{"HOME=" + os.Getenv("HOME"), "PATH=" + os.Getenv("PATH")}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+
+	values := map[string]string{}
+	for _, variable := range strings.Split(string(output), "\x00") {
+		if split := strings.SplitN(variable, "=", 2); len(split) == 2 {
+			values[split[0]] = split[1]
+		}
+	}
+	return values, nil
+}
+
+// loadMakepkgConf reads makepkg.conf into makepkgConf.
+func loadMakepkgConf() {
+	values, err := readMakepkgConf(makepkgConfPaths())
+	if err != nil {
+		outputError("Failed to read makepkg.conf: " + err.Error())
+	}
+	makepkgConf = values
+}
+
+// buildEnvironment returns the environment the sections of pkgbase run
+// in.
+func buildEnvironment(pkgbase string) []string {
+	env := map[string]string{
+		"LANG": "C",
+		"TZ":   "UTC",
+	}
+	keep, _ := setting("keepenv", "")
+	for _, key := range append(append([]string{}, keptEnvironment...), strings.Fields(keep)...) {
+		if value, ok := os.LookupEnv(key); ok {
+			env[key] = value
+		}
+	}
+	for _, key := range exportedMakepkgVariables {
+		if value, ok := makepkgSetting(key, pkgbase); ok {
+			env[key] = value
+		}
+	}
+
+	var variables []string
+	for key, value := range env {
+		variables = append(variables, key+"="+value)
+	}
+	sort.Strings(variables)
+	return variables
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadMakepkgConf(t *testing.T) {
+	dir := t.TempDir()
+	system := filepath.Join(dir, "makepkg.conf")
+	user := filepath.Join(dir, "user.conf")
+	ioutil.WriteFile(system, []byte(`
+# Flags
+CARCH="x86_64"
+CFLAGS="-march=x86-64 -O2 -pipe"
+CXXFLAGS="$CFLAGS -Wp,-D_GLIBCXX_ASSERTIONS"
+LDFLAGS="-Wl,-O1"
+BUILDENV=(!distcc color !ccache check !sign)
+OPTIONS=(strip docs !debug)
+`), 0644)
+	ioutil.WriteFile(user, []byte(`MAKEFLAGS="-j8"
+CFLAGS="$CFLAGS -g"
+`), 0644)
+
+	values, err := readMakepkgConf([]string{system, filepath.Join(dir, "missing.conf"), user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{
+		"CARCH":     "x86_64",
+		"CFLAGS":    "-march=x86-64 -O2 -pipe -g",
+		"CXXFLAGS":  "-march=x86-64 -O2 -pipe -Wp,-D_GLIBCXX_ASSERTIONS",
+		"LDFLAGS":   "-Wl,-O1",
+		"MAKEFLAGS": "-j8",
+		"OPTIONS":   "strip docs !debug",
+	} {
+		if values[key] != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, values[key])
+		}
+	}
+	if _, ok := values["RUSTFLAGS"]; ok {
+		t.Errorf("RUSTFLAGS was set without being in makepkg.conf")
+	}
+
+	saved := makepkgConf
+	defer func() { makepkgConf = saved }()
+	makepkgConf = values
+	os.Setenv("ALPMBUILD_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("ALPMBUILD_TEST_SECRET")
+	env := strings.Join(buildEnvironment("hello"), "\n")
+	if strings.Contains(env, "hunter2") || !strings.Contains(env, "\nMAKEFLAGS=-j8\n") || !strings.Contains(env, "\nLANG=C\n") {
+		t.Errorf("unexpected build environment:\n%s", env)
+	}
+
+	savedOptions := specOptions
+	defer func() { specOptions = savedOptions }()
+	makepkgConf["OPTIONS"] = "strip lto"
+	makepkgConf["LTOFLAGS"] = "-flto=auto"
+	if flags, _ := makepkgSetting("LDFLAGS", "hello"); flags != "-Wl,-O1 -flto=auto" {
+		t.Errorf("expected LTOFLAGS in LDFLAGS with lto, got %q", flags)
+	}
+	specOptions = []string{"!lto"}
+	if flags, _ := makepkgSetting("LDFLAGS", "hello"); flags != "-Wl,-O1" {
+		t.Errorf("expected no LTOFLAGS with !lto, got %q", flags)
+	}
+
+	specOptions = []string{"debug"}
+	if flags, _ := makepkgSetting("CFLAGS", "hello"); !strings.Contains(flags, "-ffile-prefix-map="+directories.Build+"=/usr/src/debug/hello") {
+		t.Errorf("expected the sources of hello to be mapped into its own directory, got %q", flags)
+	}
+}
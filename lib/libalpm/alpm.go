@@ -1,16 +1,40 @@
 package libalpm
 
 import (
-	"os/exec"
-	"strings"
+	"sort"
 )
 
 type Package struct {
 	Repository string `json:",omitempty"`
 	Name       string
 	Version    string
+
+	Description   string        `json:",omitempty"`
+	URL           string        `json:",omitempty"`
+	Architecture  string        `json:",omitempty"`
+	Provides      []string      `json:",omitempty"`
+	Depends       []string      `json:",omitempty"`
+	OptDepends    []string      `json:",omitempty"`
+	Conflicts     []string      `json:",omitempty"`
+	Replaces      []string      `json:",omitempty"`
+	Groups        []string      `json:",omitempty"`
+	Reason        InstallReason `json:",omitempty"`
+	InstalledSize int64         `json:",omitempty"`
+	// Files are the files of the package, relative to the root, which
+	// are only in files databases.
+	Files []string `json:",omitempty"`
 }
 
+// InstallReason is why an installed package was installed.
+type InstallReason int
+
+const (
+	// ReasonExplicit packages were installed on their own.
+	ReasonExplicit InstallReason = iota
+	// ReasonDepend packages were installed as dependencies of others.
+	ReasonDepend
+)
+
 type PackageField int
 
 const (
@@ -19,40 +43,23 @@ const (
 	PackageVersion
 )
 
-func ListInstalled() (pkgs []Package, err error) {
-	cmd := exec.Command("pacman", "-Q")
-	output, err := cmd.CombinedOutput()
+// ListInstalled returns the packages in the local database.
+func ListInstalled() ([]Package, error) {
+	db, err := LocalDatabase()
 	if err != nil {
-		return
+		return nil, err
 	}
-	str := string(output)
-	for _, line := range strings.Split(strings.TrimSpace(str), "\n") {
-		split := strings.Fields(line)
-		pkgs = append(pkgs, Package{
-			Name:    split[0],
-			Version: split[1],
-		})
-	}
-	return
+	return db.Packages, nil
 }
 
+// ListPackages returns the packages in the sync databases.
 func ListPackages() ([]Package, error) {
-	cmd := exec.Command("pacman", "-Sl")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return []Package{}, err
-	}
-	str := string(output)
+	dbs, err := SyncDatabases()
 	var pkgs []Package
-	for _, line := range strings.Split(strings.TrimSpace(str), "\n") {
-		split := strings.Split(line, " ")
-		pkgs = append(pkgs, Package{
-			Repository: split[0],
-			Name:       split[1],
-			Version:    split[2],
-		})
+	for _, db := range dbs {
+		pkgs = append(pkgs, db.Packages...)
 	}
-	return pkgs, nil
+	return pkgs, err
 }
 
 func ListPackagesAsString(field PackageField) ([]string, error) {
@@ -75,32 +82,26 @@ func ListPackagesAsString(field PackageField) ([]string, error) {
 	return fields, err
 }
 
+// ListGroups returns the groups of the packages in the sync databases.
 func ListGroups() []string {
-	cmd := exec.Command("pacman", "-Sg")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return []string{}
-	}
-	outputStr := strings.TrimSpace(string(output))
+	dbs, _ := SyncDatabases()
+	seen := map[string]bool{}
 	var groups []string
-	for _, line := range strings.Split(outputStr, "\n") {
-		groups = append(groups, line)
+	for _, db := range dbs {
+		for group := range db.byGroup {
+			if !seen[group] {
+				seen[group] = true
+				groups = append(groups, group)
+			}
+		}
 	}
+	sort.Strings(groups)
 	return groups
 }
 
-func PackageInstalled(packageName string) bool {
-	cmd := exec.Command("pacman", "-Qi", packageName)
-
-	if err := cmd.Start(); err != nil {
-		return false
-	}
-
-	if err := cmd.Wait(); err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			return exiterr.ExitCode() == 0
-		}
-	}
-
-	return false
+// PackageInstalled reports whether an installed package satisfies the
+// dependency dep, such as pacman>=5.2 or sh.
+func PackageInstalled(dep string) bool {
+	_, ok := InstalledSatisfier(dep)
+	return ok
 }
@@ -0,0 +1,154 @@
+package libalpm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// RootDir is the root pacman installs packages to, like pacman's --root.
+var RootDir = "/"
+
+// DBPath is the directory of pacman's databases, like pacman's --dbpath.
+// It is in RootDir unless it's set.
+var DBPath = ""
+
+func databasePath() string {
+	if DBPath != "" {
+		return DBPath
+	}
+	return filepath.Join(RootDir, "var/lib/pacman")
+}
+
+// Database is a database of packages, such as the local database of
+// installed packages.
+type Database struct {
+	Name     string
+	Packages []Package
+
+	byName     map[string]int
+	byProvides map[string][]int
+	byGroup    map[string][]int
+}
+
+func newDatabase(name string, packages []Package) *Database {
+	db := &Database{
+		Name:       name,
+		Packages:   packages,
+		byName:     map[string]int{},
+		byProvides: map[string][]int{},
+		byGroup:    map[string][]int{},
+	}
+	for i, pkg := range packages {
+		db.byName[pkg.Name] = i
+		for _, provision := range pkg.Provides {
+			name := provisionName(provision)
+			db.byProvides[name] = append(db.byProvides[name], i)
+		}
+		for _, group := range pkg.Groups {
+			db.byGroup[group] = append(db.byGroup[group], i)
+		}
+	}
+	return db
+}
+
+// provisionName is the name of what a package provides, without the
+// version of it.
+func provisionName(provision string) string {
+	if i := strings.IndexAny(provision, "<>="); i >= 0 {
+		return provision[:i]
+	}
+	return provision
+}
+
+// Package looks a package up by name.
+func (db *Database) Package(name string) (Package, bool) {
+	i, ok := db.byName[name]
+	if !ok {
+		return Package{}, false
+	}
+	return db.Packages[i], true
+}
+
+// Providers returns the packages that provide name.
+func (db *Database) Providers(name string) []Package {
+	return db.packages(db.byProvides[name])
+}
+
+// Group returns the packages in a group.
+func (db *Database) Group(name string) []Package {
+	return db.packages(db.byGroup[name])
+}
+
+func (db *Database) packages(indices []int) []Package {
+	var packages []Package
+	for _, i := range indices {
+		packages = append(packages, db.Packages[i])
+	}
+	return packages
+}
+
+// parseDesc reads a desc file of a database into pkg.
+func parseDesc(r io.Reader, pkg *Package) error {
+	err := readFields(r, pkg)
+	if err == nil && (pkg.Name == "" || pkg.Version == "") {
+		err = errors.New("missing %NAME% or %VERSION%")
+	}
+	return err
+}
+
+// readFields reads a file of a database, such as desc, into pkg. It is made
+// of fields, which are a %NAME% line followed by a value per line and an
+// empty line. Fields alpmbuild has no use for are skipped.
+func readFields(r io.Reader, pkg *Package) error {
+	lists := map[string]*[]string{
+		"%PROVIDES%":   &pkg.Provides,
+		"%DEPENDS%":    &pkg.Depends,
+		"%OPTDEPENDS%": &pkg.OptDepends,
+		"%CONFLICTS%":  &pkg.Conflicts,
+		"%REPLACES%":   &pkg.Replaces,
+		"%GROUPS%":     &pkg.Groups,
+		"%FILES%":      &pkg.Files,
+	}
+	values := map[string]*string{
+		"%NAME%":    &pkg.Name,
+		"%VERSION%": &pkg.Version,
+		"%DESC%":    &pkg.Description,
+		"%URL%":     &pkg.URL,
+		"%ARCH%":    &pkg.Architecture,
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	field := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			field = ""
+		case field == "":
+			field = line
+		case lists[field] != nil:
+			*lists[field] = append(*lists[field], line)
+		case values[field] != nil:
+			*values[field] = line
+		case field == "%REASON%":
+			reason, err := strconv.Atoi(line)
+			if err != nil {
+				return fmt.Errorf("bad install reason %q", line)
+			}
+			pkg.Reason = InstallReason(reason)
+		case field == "%SIZE%" || field == "%ISIZE%":
+			size, err := strconv.ParseInt(line, 10, 64)
+			if err != nil {
+				return fmt.Errorf("bad size %q", line)
+			}
+			pkg.InstalledSize = size
+		}
+	}
+	return scanner.Err()
+}
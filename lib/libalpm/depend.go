@@ -0,0 +1,120 @@
+package libalpm
+
+import "strings"
+
+// DepMod is how a dependency constrains the version of what it depends on.
+type DepMod int
+
+const (
+	DepModAny DepMod = iota
+	DepModEQ
+	DepModGE
+	DepModLE
+	DepModGT
+	DepModLT
+)
+
+// depMods are the operators of dependencies. Longer operators come first,
+// so that >= isn't taken for >.
+var depMods = []struct {
+	Operator string
+	Mod      DepMod
+}{
+	{">=", DepModGE},
+	{"<=", DepModLE},
+	{"==", DepModEQ},
+	{"=", DepModEQ},
+	{">", DepModGT},
+	{"<", DepModLT},
+}
+
+// Depend is a dependency, such as pacman>=5.2.
+type Depend struct {
+	Name    string
+	Mod     DepMod
+	Version string
+}
+
+// ParseDepend parses a dependency in the form pacman uses, such as
+// pacman>=5.2. == is taken for =, like rpm does.
+func ParseDepend(dep string) Depend {
+	i := strings.IndexAny(dep, "<>=")
+	if i < 0 {
+		return Depend{Name: dep}
+	}
+	for _, mod := range depMods {
+		if strings.HasPrefix(dep[i:], mod.Operator) {
+			return Depend{
+				Name:    dep[:i],
+				Mod:     mod.Mod,
+				Version: dep[i+len(mod.Operator):],
+			}
+		}
+	}
+	return Depend{Name: dep}
+}
+
+// Operator returns the operator of the dependency, which is empty if any
+// version will do.
+func (dep Depend) Operator() string {
+	for _, mod := range depMods {
+		if mod.Mod == dep.Mod {
+			return mod.Operator
+		}
+	}
+	return ""
+}
+
+func (dep Depend) String() string {
+	if dep.Mod == DepModAny {
+		return dep.Name
+	}
+	if dep.Mod == DepModEQ {
+		return dep.Name + "=" + dep.Version
+	}
+	return dep.Name + dep.Operator() + dep.Version
+}
+
+// SatisfiedByVersion reports whether version is a version the dependency
+// allows.
+func (dep Depend) SatisfiedByVersion(version string) bool {
+	if dep.Mod == DepModAny {
+		return true
+	}
+	compared := VerCmp(version, dep.Version)
+	switch dep.Mod {
+	case DepModEQ:
+		return compared == 0
+	case DepModGE:
+		return compared >= 0
+	case DepModLE:
+		return compared <= 0
+	case DepModGT:
+		return compared > 0
+	case DepModLT:
+		return compared < 0
+	}
+	return false
+}
+
+// SatisfiedBy reports whether pkg satisfies the dependency, either by its
+// name or by something it provides. Like with pacman, a provision without
+// a version doesn't satisfy a dependency on a version.
+func (dep Depend) SatisfiedBy(pkg Package) bool {
+	if pkg.Name == dep.Name && dep.SatisfiedByVersion(pkg.Version) {
+		return true
+	}
+	for _, provision := range pkg.Provides {
+		provided := ParseDepend(provision)
+		if provided.Name != dep.Name {
+			continue
+		}
+		if dep.Mod == DepModAny {
+			return true
+		}
+		if provided.Mod == DepModEQ && dep.SatisfiedByVersion(provided.Version) {
+			return true
+		}
+	}
+	return false
+}
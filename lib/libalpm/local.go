@@ -0,0 +1,73 @@
+package libalpm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ReadLocalDatabase reads the local database of the installed packages
+// from the local directory of dbpath. Every package has a directory in it
+// with a desc file.
+func ReadLocalDatabase(dbpath string) (*Database, error) {
+	dir := filepath.Join(dbpath, "local")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var packages []Package
+	for _, entry := range entries {
+		// The directory also holds ALPM_DB_VERSION.
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name(), "desc")
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		var pkg Package
+		err = parseDesc(file, &pkg)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		packages = append(packages, pkg)
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].Name < packages[j].Name
+	})
+	return newDatabase("local", packages), nil
+}
+
+var localDatabase struct {
+	sync.Mutex
+	path string
+	db   *Database
+	err  error
+}
+
+// LocalDatabase returns the local database in DBPath. It is only read again
+// when DBPath changes, or when RefreshLocalDatabase reads it again.
+func LocalDatabase() (*Database, error) {
+	localDatabase.Lock()
+	defer localDatabase.Unlock()
+	if localDatabase.path != databasePath() {
+		localDatabase.db, localDatabase.err = ReadLocalDatabase(databasePath())
+		localDatabase.path = databasePath()
+	}
+	return localDatabase.db, localDatabase.err
+}
+
+// RefreshLocalDatabase reads the local database again, after packages
+// were installed or removed.
+func RefreshLocalDatabase() (*Database, error) {
+	localDatabase.Lock()
+	defer localDatabase.Unlock()
+	localDatabase.db, localDatabase.err = ReadLocalDatabase(databasePath())
+	localDatabase.path = databasePath()
+	return localDatabase.db, localDatabase.err
+}
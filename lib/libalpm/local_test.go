@@ -0,0 +1,44 @@
+package libalpm
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadLocalDatabase(t *testing.T) {
+	db, err := ReadLocalDatabase(filepath.Join("testdata", "local"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Packages) != 3 || db.Packages[0].Name != "bash" {
+		t.Fatalf("unexpected packages %+v", db.Packages)
+	}
+
+	pacman, ok := db.Package("pacman")
+	if !ok {
+		t.Fatal("pacman is missing")
+	}
+	if pacman.Version != "6.0.1-1" || pacman.Reason != ReasonExplicit || pacman.InstalledSize != 4800000 {
+		t.Errorf("unexpected package %+v", pacman)
+	}
+	if !reflect.DeepEqual(pacman.Provides, []string{"libalpm.so=13-64"}) || !reflect.DeepEqual(pacman.Groups, []string{"base-devel"}) || len(pacman.Depends) != 7 {
+		t.Errorf("unexpected lists in %+v", pacman)
+	}
+	if pacman.OptDepends[0] != "perl-locale-gettext: translation support in makepkg-template" {
+		t.Errorf("unexpected optional dependencies %q", pacman.OptDepends)
+	}
+
+	bash, _ := db.Package("bash")
+	glibc, _ := db.Package("glibc")
+	if bash.Reason != ReasonDepend || !reflect.DeepEqual(bash.Provides, []string{"sh"}) || !reflect.DeepEqual(glibc.Conflicts, []string{"glibc-git"}) {
+		t.Errorf("unexpected packages %+v and %+v", bash, glibc)
+	}
+	if _, ok := db.Package("sh"); ok {
+		t.Errorf("a provision was found as a package")
+	}
+
+	if _, err := ReadLocalDatabase(filepath.Join("testdata", "missing")); err == nil {
+		t.Errorf("a missing database was read")
+	}
+}
@@ -0,0 +1,60 @@
+package libalpm
+
+// FindSatisfier returns the package of the database that satisfies dep.
+// A package with the name of the dependency is preferred over packages
+// that provide it, like pacman prefers it.
+func (db *Database) FindSatisfier(dep Depend) (Package, bool) {
+	if pkg, ok := db.Package(dep.Name); ok && dep.SatisfiedBy(pkg) {
+		return pkg, true
+	}
+	for _, pkg := range db.Providers(dep.Name) {
+		if dep.SatisfiedBy(pkg) {
+			return pkg, true
+		}
+	}
+	return Package{}, false
+}
+
+// FindSatisfier returns the first package of the databases that satisfies
+// the dependency dep, such as sh or java-runtime>=11.
+func FindSatisfier(dbs []*Database, dep string) (Package, bool) {
+	depend := ParseDepend(dep)
+	for _, db := range dbs {
+		if pkg, ok := db.FindSatisfier(depend); ok {
+			return pkg, true
+		}
+	}
+	return Package{}, false
+}
+
+// InstalledSatisfier returns the installed package that satisfies dep.
+func InstalledSatisfier(dep string) (Package, bool) {
+	db, err := LocalDatabase()
+	if err != nil {
+		return Package{}, false
+	}
+	return FindSatisfier([]*Database{db}, dep)
+}
+
+// SyncSatisfier returns the package of the sync databases that would be
+// installed to satisfy dep.
+func SyncSatisfier(dep string) (Package, bool) {
+	dbs, _ := SyncDatabases()
+	return FindSatisfier(dbs, dep)
+}
+
+// FindFileOwner returns the first package of the databases with a file
+// that matches, and the file. The files of packages are relative to the
+// root, such as usr/bin/bash.
+func FindFileOwner(dbs []*Database, match func(file string) bool) (Package, string, bool) {
+	for _, db := range dbs {
+		for _, pkg := range db.Packages {
+			for _, file := range pkg.Files {
+				if match(file) {
+					return pkg, file, true
+				}
+			}
+		}
+	}
+	return Package{}, "", false
+}
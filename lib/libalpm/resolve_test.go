@@ -0,0 +1,61 @@
+package libalpm
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFindSatisfier(t *testing.T) {
+	local, err := ReadLocalDatabase(filepath.Join("testdata", "local"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	core, err := ReadSyncDatabase(filepath.Join("testdata", "sync", "sync", "core.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbs := []*Database{local, core}
+
+	for dep, expected := range map[string]string{
+		"bash":               "bash",
+		"sh":                 "bash",
+		"libalpm.so=13-64":   "pacman",
+		"libalpm.so>=12":     "pacman",
+		"libalpm.so":         "pacman",
+		"pacman>=5.2":        "pacman",
+		"glibc=2.33":         "glibc",
+		"libalpm.so=12-64":   "",
+		"sh>=1":              "",
+		"pacman<6":           "",
+		"java-runtime":       "",
+		"not-a-package>=1.0": "",
+	} {
+		pkg, ok := FindSatisfier(dbs, dep)
+		if pkg.Name != expected || ok != (expected != "") {
+			t.Errorf("FindSatisfier(%q) = %q, %v, expected %q", dep, pkg.Name, ok, expected)
+		}
+	}
+	if pkg, _ := FindSatisfier([]*Database{core, local}, "bash"); pkg.Repository != "core" {
+		t.Errorf("the databases were not looked up in order")
+	}
+}
+
+func TestFindFileOwner(t *testing.T) {
+	dbs, err := ReadSyncDatabases(filepath.Join("testdata", "sync"), ".files", filepath.Join("testdata", "sync", "pacman.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, expected := range map[string]string{
+		"usr/bin/sh":                    "bash",
+		"usr/lib/pkgconfig/gtk+-3.0.pc": "gtk3",
+		"usr/bin/zsh":                   "",
+	} {
+		pkg, found, ok := FindFileOwner(dbs, func(path string) bool { return path == file })
+		if pkg.Name != expected || ok != (expected != "") || (ok && found != file) {
+			t.Errorf("FindFileOwner(%q) = %q, %q, %v, expected %q", file, pkg.Name, found, ok, expected)
+		}
+	}
+	if bash, _ := dbs[1].Package("bash"); bash.Version != "5.1.008-1" || len(bash.Files) != 5 {
+		t.Errorf("unexpected package %+v", bash)
+	}
+}
@@ -0,0 +1,209 @@
+package libalpm
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ConfigFile is pacman's configuration file, which the order of the sync
+// databases is taken from.
+var ConfigFile = "/etc/pacman.conf"
+
+// decompress returns the contents of a database, which is compressed with
+// whatever repo-add was told to use. Formats the standard library doesn't
+// have are decompressed by their tools.
+func decompress(file *os.File) (io.Reader, func() error, error) {
+	reader := bufio.NewReader(file)
+	magic, _ := reader.Peek(6)
+	noop := func() error { return nil }
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(reader)
+		return gz, noop, err
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(reader), noop, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return decompressWith(reader, "zstd", "-d", "-c", "-q")
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return decompressWith(reader, "xz", "-d", "-c")
+	}
+	return reader, noop, nil
+}
+
+func decompressWith(input io.Reader, command string, args ...string) (io.Reader, func() error, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Stdin = input
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	wait := func() error {
+		if err := cmd.Wait(); err != nil {
+			return fmt.Errorf("%s failed: %s", command, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+	return output, wait, nil
+}
+
+// ReadSyncDatabase reads the sync database at path, which is a tar archive
+// with a directory per package, holding its desc file. The directories of
+// files databases also hold the files of the package.
+func ReadSyncDatabase(path string) (*Database, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	input, wait, err := decompress(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), ".db"), ".files")
+	var packages []Package
+	directories := map[string]int{}
+	archive := tar.NewReader(input)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			wait()
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		directory, entry := filepath.Split(header.Name)
+		if entry != "desc" && entry != "files" {
+			continue
+		}
+		i, ok := directories[directory]
+		if !ok {
+			i = len(packages)
+			directories[directory] = i
+			packages = append(packages, Package{Repository: name})
+		}
+		err = readFields(archive, &packages[i])
+		if err != nil {
+			wait()
+			return nil, fmt.Errorf("%s: %s: %s", path, header.Name, err.Error())
+		}
+	}
+	for _, pkg := range packages {
+		if pkg.Name == "" || pkg.Version == "" {
+			wait()
+			return nil, fmt.Errorf("%s: %s has no %%NAME%% or %%VERSION%%", path, pkg.Name)
+		}
+	}
+	// The rest of the archive is padding, which has to be read for the
+	// decompressor to finish.
+	io.Copy(ioutil.Discard, input)
+	if err := wait(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return newDatabase(name, packages), nil
+}
+
+// repositoryOrder returns the repositories of pacman's configuration file
+// in the order they are in, which is the order pacman looks them up in.
+func repositoryOrder(config string) []string {
+	file, err := os.Open(config)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	var repositories []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") && line != "[options]" {
+			repositories = append(repositories, strings.Trim(line, "[]"))
+		}
+	}
+	return repositories
+}
+
+// ReadSyncDatabases reads the sync databases in the sync directory of
+// dbpath, which end in suffix: .db, or .files for the files databases.
+// They are in the order of the repositories in config, followed by the
+// ones it doesn't have in alphabetical order.
+func ReadSyncDatabases(dbpath, suffix, config string) ([]*Database, error) {
+	paths, err := filepath.Glob(filepath.Join(dbpath, "sync", "*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+	order := map[string]int{}
+	for i, repository := range repositoryOrder(config) {
+		order[repository] = i + 1
+	}
+	rank := func(path string) int {
+		if i, ok := order[strings.TrimSuffix(filepath.Base(path), suffix)]; ok {
+			return i
+		}
+		return len(order) + 1
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return rank(paths[i]) < rank(paths[j])
+	})
+
+	var dbs []*Database
+	for _, path := range paths {
+		db, err := ReadSyncDatabase(path)
+		if err != nil {
+			return dbs, err
+		}
+		dbs = append(dbs, db)
+	}
+	return dbs, nil
+}
+
+// databaseCache keeps databases once they're read, until where they are
+// read from changes.
+type databaseCache struct {
+	sync.Mutex
+	source string
+	dbs    []*Database
+	err    error
+}
+
+func (cache *databaseCache) get(suffix string) ([]*Database, error) {
+	cache.Lock()
+	defer cache.Unlock()
+	source := databasePath() + "\x00" + ConfigFile
+	if cache.source != source {
+		cache.dbs, cache.err = ReadSyncDatabases(databasePath(), suffix, ConfigFile)
+		cache.source = source
+	}
+	return cache.dbs, cache.err
+}
+
+var syncDatabases, filesDatabases databaseCache
+
+// SyncDatabases returns the sync databases in DBPath. They are only read
+// again when DBPath or ConfigFile change.
+func SyncDatabases() ([]*Database, error) {
+	return syncDatabases.get(".db")
+}
+
+// FilesDatabases returns the files databases in DBPath, which pacman -Fy
+// downloads. They are only read again when DBPath or ConfigFile change.
+func FilesDatabases() ([]*Database, error) {
+	return filesDatabases.get(".files")
+}
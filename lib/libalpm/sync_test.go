@@ -0,0 +1,41 @@
+package libalpm
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSyncDatabases(t *testing.T) {
+	core, err := ReadSyncDatabase(filepath.Join("testdata", "sync", "sync", "core.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bash, ok := core.Package("bash")
+	if !ok || bash.Repository != "core" || bash.Version != "5.1.008-1" || bash.InstalledSize != 8364032 || len(bash.Depends) != 4 {
+		t.Errorf("unexpected package %+v", bash)
+	}
+	if providers := core.Providers("sh"); len(providers) != 1 || providers[0].Name != "bash" {
+		t.Errorf("unexpected providers of sh: %+v", providers)
+	}
+	if base := core.Group("base"); len(base) != 2 {
+		t.Errorf("unexpected base group: %+v", base)
+	}
+
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+	dbs, err := ReadSyncDatabases(filepath.Join("testdata", "sync"), ".db", filepath.Join("testdata", "sync", "pacman.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dbs) != 2 || dbs[0].Name != "extra" || dbs[1].Name != "core" {
+		t.Fatalf("databases are not in the order of pacman.conf: %+v", dbs)
+	}
+	if providers := dbs[0].Providers("java-runtime"); len(providers) != 1 || providers[0].Name != "jre-openjdk" {
+		t.Errorf("unexpected providers of java-runtime: %+v", providers)
+	}
+	if gtk3, ok := dbs[0].Package("gtk3"); !ok || gtk3.Version != "1:3.24.30-1" || gtk3.Groups[0] != "gnome" {
+		t.Errorf("unexpected package %+v", gtk3)
+	}
+}
@@ -0,0 +1,143 @@
+package libalpm
+
+import "strings"
+
+// This is a port of pacman's alpm_pkg_vercmp, which is a port of rpm's
+// rpmvercmp, so that versions compare like they do for pacman.
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || isAlpha(c)
+}
+
+// rpmvercmp compares two version strings segment by segment. Segments are
+// runs of digits or letters; numeric segments are newer than alphabetic
+// ones.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	one, two := 0, 0
+	ptr1, ptr2 := 0, 0
+	isnum := false
+
+	for one < len(a) && two < len(b) {
+		for one < len(a) && !isAlnum(a[one]) {
+			one++
+		}
+		for two < len(b) && !isAlnum(b[two]) {
+			two++
+		}
+		if one >= len(a) || two >= len(b) {
+			break
+		}
+		// More separators mean a newer version, so that 1.0.1 is newer
+		// than 1.01, say.
+		if one-ptr1 != two-ptr2 {
+			if one-ptr1 < two-ptr2 {
+				return -1
+			}
+			return 1
+		}
+
+		ptr1, ptr2 = one, two
+		if isDigit(a[ptr1]) {
+			for ptr1 < len(a) && isDigit(a[ptr1]) {
+				ptr1++
+			}
+			for ptr2 < len(b) && isDigit(b[ptr2]) {
+				ptr2++
+			}
+			isnum = true
+		} else {
+			for ptr1 < len(a) && isAlpha(a[ptr1]) {
+				ptr1++
+			}
+			for ptr2 < len(b) && isAlpha(b[ptr2]) {
+				ptr2++
+			}
+			isnum = false
+		}
+
+		// The segments are of different types.
+		if two == ptr2 {
+			if isnum {
+				return 1
+			}
+			return -1
+		}
+
+		segment1, segment2 := a[one:ptr1], b[two:ptr2]
+		if isnum {
+			segment1 = strings.TrimLeft(segment1, "0")
+			segment2 = strings.TrimLeft(segment2, "0")
+			if len(segment1) > len(segment2) {
+				return 1
+			}
+			if len(segment2) > len(segment1) {
+				return -1
+			}
+		}
+		if compared := strings.Compare(segment1, segment2); compared != 0 {
+			return compared
+		}
+		one, two = ptr1, ptr2
+	}
+
+	if one >= len(a) && two >= len(b) {
+		return 0
+	}
+	// Whatever is left over decides. A version with letters left over is
+	// older, like 1.0a is older than 1.0, and otherwise the longer one is
+	// newer.
+	if (one >= len(a) && !isAlpha(b[two])) || (one < len(a) && isAlpha(a[one])) {
+		return -1
+	}
+	return 1
+}
+
+// parseEVR splits a version into its epoch, version and release. The
+// epoch is 0 if there is none, and the release is empty.
+func parseEVR(evr string) (epoch, version, release string) {
+	digits := 0
+	for digits < len(evr) && isDigit(evr[digits]) {
+		digits++
+	}
+	epoch, version = "0", evr
+	if digits < len(evr) && evr[digits] == ':' {
+		if digits > 0 {
+			epoch = evr[:digits]
+		}
+		version = evr[digits+1:]
+	}
+	if i := strings.LastIndex(version, "-"); i >= 0 {
+		version, release = version[:i], version[i+1:]
+	}
+	return
+}
+
+// VerCmp compares two package versions like pacman's vercmp, returning -1
+// if a is older than b, 0 if they're the same and 1 if a is newer. The
+// releases are only compared if both versions have one.
+func VerCmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	epoch1, version1, release1 := parseEVR(a)
+	epoch2, version2, release2 := parseEVR(b)
+	ret := rpmvercmp(epoch1, epoch2)
+	if ret == 0 {
+		ret = rpmvercmp(version1, version2)
+		if ret == 0 && release1 != "" && release2 != "" {
+			ret = rpmvercmp(release1, release2)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,88 @@
+package libalpm
+
+import "testing"
+
+func TestVerCmp(t *testing.T) {
+	// These are from pacman's vercmp tests.
+	for _, test := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.5.0", "1.5.0", 0},
+		{"1.5.1", "1.5.0", 1},
+		{"1.5.1", "1.5", 1},
+		{"1.5.0-1", "1.5.0-1", 0},
+		{"1.5.0-1", "1.5.0-2", -1},
+		{"1.5.0-1", "1.5.1-1", -1},
+		{"1.5.0-2", "1.5.1-1", -1},
+		{"1.5-1", "1.5", 0},
+		{"1.1-1", "1.1", 0},
+		{"1.0-1", "1.1", -1},
+		{"1.1-1", "1.0", 1},
+		{"1.5b-1", "1.5-1", -1},
+		{"1.5b", "1.5", -1},
+		{"1.5b-1", "1.5", -1},
+		{"1.5b", "1.5.1", -1},
+		{"1.0a", "1.0alpha", -1},
+		{"1.0alpha", "1.0b", -1},
+		{"1.0b", "1.0beta", -1},
+		{"1.0beta", "1.0rc", -1},
+		{"1.0rc", "1.0", -1},
+		{"1.5.a", "1.5", 1},
+		{"1.5.b", "1.5.a", 1},
+		{"1.5.1", "1.5.b", 1},
+		{"1.5.b-1", "1.5.b", 0},
+		{"1.5-1", "1.5.b", -1},
+		{"2.0", "2_0", 0},
+		{"2.0_a", "2_0.a", 0},
+		{"2.0a", "2.0.a", -1},
+		{"2___a", "2_a", 1},
+		{"0:1.0", "0:1.0", 0},
+		{"0:1.0", "0:1.1", -1},
+		{"1:1.0", "0:1.0", 1},
+		{"1:1.0", "0:1.1", 1},
+		{"1:1.0", "2:1.1", -1},
+		{"0:1.0", "1.0", 0},
+		{"0:1.0", "1.1", -1},
+		{"0:1.1", "1.0", 1},
+		{"1:1.0", "1.0", 1},
+		{"1:1.0-1", "1.0-2", 1},
+		{":1.0", "1.0", 0},
+		{"1.0-1", "1.0-1.5", -1},
+		{"1.0-1.5", "1.0-1.5.1", -1},
+		{"1.01", "1.1", 0},
+	} {
+		if result := VerCmp(test.a, test.b); result != test.expected {
+			t.Errorf("VerCmp(%q, %q) = %d, expected %d", test.a, test.b, result, test.expected)
+		}
+		if result := VerCmp(test.b, test.a); result != -test.expected {
+			t.Errorf("VerCmp(%q, %q) = %d, expected %d", test.b, test.a, result, -test.expected)
+		}
+	}
+}
+
+func TestParseDepend(t *testing.T) {
+	for _, test := range []struct {
+		dep       string
+		expected  Depend
+		satisfied bool
+	}{
+		{"pacman", Depend{Name: "pacman"}, true},
+		{"pacman>=5.2", Depend{"pacman", DepModGE, "5.2"}, true},
+		{"pacman==6.0.1", Depend{"pacman", DepModEQ, "6.0.1"}, true},
+		{"pacman<6", Depend{"pacman", DepModLT, "6"}, false},
+		{"pacman>6.0.1-0", Depend{"pacman", DepModGT, "6.0.1-0"}, true},
+		{"pacman<=1:1.0", Depend{"pacman", DepModLE, "1:1.0"}, true},
+	} {
+		dep := ParseDepend(test.dep)
+		if dep != test.expected {
+			t.Errorf("ParseDepend(%q) = %+v, expected %+v", test.dep, dep, test.expected)
+		}
+		if satisfied := dep.SatisfiedBy(Package{Name: "pacman", Version: "6.0.1-1"}); satisfied != test.satisfied {
+			t.Errorf("%s satisfied by pacman 6.0.1-1: %v", dep, satisfied)
+		}
+	}
+	if dep := ParseDepend("pacman==6.0.1").String(); dep != "pacman=6.0.1" {
+		t.Errorf("unexpected normalised dependency %q", dep)
+	}
+}
@@ -1,6 +1,8 @@
 package librpm
 
 // #cgo pkg-config: rpm
+// #include <stdio.h>
+// #include <stdlib.h>
 // #include <rpm/rpmmacro.h>
 //
 // static char* expandy(char* in) {
@@ -13,10 +15,16 @@ package librpm
 // static int loadfromfile(char* path) {
 //	return rpmLoadMacroFile(NULL, path);
 // }
-// static void dumpmacros() {
-//	FILE* file = fopen("/tmp/alpmbuild", "w+");
+// static char* dumpmacros() {
+//	char* buffer = NULL;
+//	size_t size = 0;
+//	FILE* file = open_memstream(&buffer, &size);
+//	if (file == NULL) {
+//		return NULL;
+//	}
 //	rpmDumpMacroTable(NULL, file);
 //	fclose(file);
+//	return buffer;
 // }
 // static void delmacro(char* macro) {
 //	delMacro(NULL, macro);
@@ -24,7 +32,6 @@ package librpm
 //
 import "C"
 import (
-	"io/ioutil"
 	"strings"
 	"unsafe"
 )
@@ -70,14 +77,21 @@ func LoadFromFile(path string) int {
 	return int(result)
 }
 
-func DumpMacros() []Macro {
-	C.dumpmacros()
-
-	bytes, err := ioutil.ReadFile("/tmp/alpmbuild")
-	if err != nil {
-		return []Macro{}
+// dumpMacroTable returns rpm's macro table as printed by rpmDumpMacroTable.
+// It is dumped to memory, so that builds running at the same time don't
+// overwrite each other's dumps.
+func dumpMacroTable() string {
+	dump := C.dumpmacros()
+	if dump == nil {
+		return ""
 	}
-	str := string(bytes)
+	defer C.free(unsafe.Pointer(dump))
+
+	return C.GoString(dump)
+}
+
+func DumpMacros() []Macro {
+	str := dumpMacroTable()
 
 	macros := []Macro{}
 
@@ -95,13 +109,7 @@ func DumpMacros() []Macro {
 }
 
 func DumpMacroNamesAsString() []string {
-	C.dumpmacros()
-
-	bytes, err := ioutil.ReadFile("/tmp/alpmbuild")
-	if err != nil {
-		return []string{}
-	}
-	str := string(bytes)
+	str := dumpMacroTable()
 
 	macros := []string{}
 
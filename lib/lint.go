@@ -1,15 +1,12 @@
 package lib
 
 import (
-	"bufio"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 	"unicode"
 
@@ -54,17 +51,22 @@ func lintPackageName(name string) (BadNameReason, int) {
 	return ValidName, -1
 }
 
-func lintDependency(name string) (string, bool) {
+// lintDependency checks that a package in the repositories satisfies the
+// dependency dep, by its name or by what it provides. If none does, it
+// returns a hint for fixing the dependency.
+func lintDependency(dep string) (string, bool) {
+	if _, ok := libalpm.SyncSatisfier(dep); ok {
+		return "", false
+	}
+	name := libalpm.ParseDepend(dep).Name
+	if pkg, ok := libalpm.SyncSatisfier(name); ok {
+		return fmt.Sprintf("%s has version %s in the repositories", highlight(pkg.Name), highlight(pkg.Version)), true
+	}
 	if !pkgNamesInitted {
 		pkgNames, _ = libalpm.ListPackagesAsString(libalpm.PackageName)
 		pkgNamesInitted = true
 	}
-	for _, pkgName := range pkgNames {
-		if pkgName == name {
-			return "", false
-		}
-	}
-	return ClosestString(name, pkgNames), true
+	return fmt.Sprintf("Did you mean to use %s?", highlight(ClosestString(name, pkgNames))), true
 }
 
 func lintGroup(name string) (string, bool) {
@@ -80,54 +82,15 @@ func lintGroup(name string) (string, bool) {
 	return ClosestString(name, groupNames), true
 }
 
-func promptMissingDepsInstall(pkg PackageContext) {
-	if *fakeroot || *ignoreDeps {
-		return
-	}
-
-	var missingDeps []string
-
-	for _, pkg := range append(append(pkg.Requires, pkg.BuildRequires...), pkg.CheckRequires...) {
-		if !libalpm.PackageInstalled(pkg) {
-			missingDeps = append(missingDeps, pkg)
-		}
-	}
-
-	println(red("==>"), highlight(strconv.Itoa(len(missingDeps))), bold("package(s) need installation to build"), highlight(pkg.Name)+bold(":"))
-	println(bold("    Actions: Install (i), List (l), Abort (default: a)"))
-	println()
-	print("  " + bold("-> "))
-
-	reader := bufio.NewReader(os.Stdin)
-
-	abort := func() {
-		outputError("Cannot build package without dependencies, aborting...")
-		os.Exit(1)
-	}
-
-	text, err := reader.ReadString('\n')
-	if err != nil {
-		abort()
-	}
-	text = strings.ReplaceAll(text, "\n", "")
-
-	if strings.Contains(text, "i") {
-		cmd := exec.Command("pkexec", append([]string{"pacman", "-S"}, missingDeps...)...)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Run()
-		if cmd.ProcessState.ExitCode() != 0 {
-			abort()
-		}
-		return
-	} else if strings.Contains(text, "l") {
-		outputStatus(strings.Join(missingDeps, " "))
-		os.Exit(0)
-	} else if strings.Contains(text, "a") {
-		abort()
+// buildDependencies returns the packages that have to be installed to build
+// pkg. CheckRequires are recorded in .PKGINFO either way, but they're only
+// needed to build the package if %check runs.
+func (pkg PackageContext) buildDependencies() []string {
+	needed := append(append([]string{}, pkg.Requires...), pkg.BuildRequires...)
+	if plan.checks() {
+		needed = append(needed, pkg.CheckRequires...)
 	}
-	abort()
+	return needed
 }
 
 //* Built package linting
@@ -144,14 +107,17 @@ func (pkg PackageContext) lintAll() {
 }
 
 func (pkg PackageContext) lintForReferencesToBuildDirectory() {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		outputError("Could not get user's home directory.")
-	}
-	err = filepath.Walk(
+	err := filepath.Walk(
 		pkg.PackageRoot(),
 		func(path string, info os.FileInfo, err error) error {
 			if info.IsDir() {
+				// Debug info refers to where it was built by nature.
+				if relative, _ := filepath.Rel(pkg.PackageRoot(), path); "/"+relative == debugDirectory {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
 				return nil
 			}
 			content, err := ioutil.ReadFile(path)
@@ -159,7 +125,9 @@ func (pkg PackageContext) lintForReferencesToBuildDirectory() {
 				outputError("Failed to open file " + highlight(pkg.trimPath(path)) + " in package " + highlight(pkg.GetNevra()) + ": " + err.Error())
 			}
 			strContent := string(content)
-			if strings.Contains(strContent, filepath.Join(home, "alpmbuild")) {
+			if strings.Contains(strContent, directories.Top) ||
+				strings.Contains(strContent, directories.Build) ||
+				strings.Contains(strContent, directories.BuildRoot) {
 				outputWarning(
 					fmt.Sprintf(
 						"Package %s contains a reference to the build directory in file %s",
@@ -3,9 +3,6 @@ package lib
 import (
 	"flag"
 	"fmt"
-	"os"
-	"path"
-	"path/filepath"
 	"strings"
 
 	"github.com/appadeia/alpmbuild/lib/librpm"
@@ -36,17 +33,39 @@ var macros = map[string]string{
 
 var expanded = false
 
-func getExtractCommandForName(name string, quiet bool) string {
+// getExtractCommandForSource unpacks source into dest. Archives carry their
+// own top level directory and are always unpacked into the current one, but
+// VCS checkouts are copied to dest as if they were the archive's contents.
+func getExtractCommandForSource(source Source, quiet bool, dest string) string {
+	name := source.fileName()
+	if _, ok := source.vcs(); ok {
+		return "cp -a %{_builddir}/" + name + " " + dest
+	}
 	if strings.HasSuffix(name, ".zip") {
 		if quiet {
-			return "%{__unzip} -qq %{_sourcedir}/" + path.Base(name)
+			return "%{__unzip} -qq %{_builddir}/" + name
 		}
-		return "%{__unzip} %{_sourcedir}/" + path.Base(name)
+		return "%{__unzip} %{_builddir}/" + name
 	}
 	if quiet {
-		return "%{__tar} -xf %{_sourcedir}/" + path.Base(name)
+		return "%{__tar} -xf %{_builddir}/" + name
+	}
+	return "%{__tar} -xvvf %{_builddir}/" + name
+}
+
+// setupDirectory returns the directory a %setup line names with -n, with
+// its macros expanded, or nothing if it doesn't name one.
+func setupDirectory(input string) string {
+	fields := strings.Fields(input)
+	if len(fields) == 0 || fields[0] != "%setup" {
+		return ""
+	}
+	for i, field := range fields[1:] {
+		if field == "-n" && i+2 < len(fields) {
+			return librpm.ExpandMacro(fields[i+2])
+		}
 	}
-	return "%{__tar} -xvvf %{_sourcedir}/" + path.Base(name)
+	return ""
 }
 
 func evalInlineMacros(input string, context PackageContext) string {
@@ -56,22 +75,27 @@ func evalInlineMacros(input string, context PackageContext) string {
 		for macro, expandTo := range macros {
 			librpm.DefineMacro(macro+" "+expandTo, 256)
 		}
-		home, err := os.UserHomeDir()
-		if err != nil {
-			outputError("Could not get user's home directory.")
-		}
 		librpm.LoadFromFile("/usr/lib/rpm/macros")
-		librpm.DefineMacro(fmt.Sprintf("buildroot %s", filepath.Join(home, "alpmbuild/package")), 0)
-		librpm.DefineMacro(fmt.Sprintf("_sourcedir %s", filepath.Join(home, "alpmbuild/sources")), 0)
+		librpm.DefineMacro(fmt.Sprintf("_topdir %s", directories.Top), 0)
+		librpm.DefineMacro(fmt.Sprintf("buildroot %s", directories.BuildRoot), 0)
+		librpm.DefineMacro(fmt.Sprintf("_sourcedir %s", directories.Sources), 0)
+		librpm.DefineMacro(fmt.Sprintf("_builddir %s", directories.Build), 0)
 	}
 	if context.Name != "" {
 		librpm.DefineMacro("name "+context.Name, 0)
+		// The flags map the paths of sources to a directory named after the
+		// package, so they are set once its name is known.
+		for macro, variable := range makepkgMacros {
+			if value, ok := makepkgSetting(variable, context.Name); ok {
+				librpm.DefineMacro(fmt.Sprintf("%s %s", macro, value), 0)
+			}
+		}
 	}
 	if context.Version != "" {
 		librpm.DefineMacro("version "+context.Version, 0)
 	}
 	if context.Name != "" && context.Version != "" {
-		librpm.DefineMacro(fmt.Sprintf("buildsubdir %s-%s", context.Name, context.Version), 0)
+		librpm.DefineMacro("buildsubdir "+context.buildSubdirectory(), 0)
 	}
 	if strings.Contains(input, "%setup") {
 		set := flag.NewFlagSet("setup", flag.ContinueOnError)
@@ -80,29 +104,40 @@ func evalInlineMacros(input string, context PackageContext) string {
 		doNotDeleteDirectory := set.Bool("D", false, "")
 		unpackQuietly := set.Bool("q", false, "")
 		skipDefaultSource := set.Bool("T", false, "")
+		set.String("n", "", "")
 
-		set.Parse(strings.Split(input, " ")[1:])
+		set.Parse(strings.Fields(input)[1:])
+		buildsubdir := context.buildSubdirectory()
+		if dir := setupDirectory(input); dir != "" {
+			librpm.DefineMacro("buildsubdir "+dir, 0)
+			buildsubdir = dir
+		}
+		// A checkout that -n names is already where it would be copied to,
+		// so it is used as it is instead of being removed or copied onto
+		// itself.
+		_, isVCS := context.Sources[0].vcs()
+		inPlace := isVCS && context.Sources[0].fileName() == buildsubdir
 
 		script := ""
 
-		if !*doNotDeleteDirectory {
+		if !*doNotDeleteDirectory && !inPlace {
 			script += "rm -rf %{buildsubdir}\n"
 		}
-		if *createDir {
+		if *createDir && !inPlace {
 			script += `mkdir -p %{buildsubdir}
 cd %{buildsubdir}` + "\n"
-		} else if !*skipDefaultSource {
-			script += fmt.Sprintf("%s\n", getExtractCommandForName(context.Sources[0].URL, *unpackQuietly))
+		} else if !*skipDefaultSource && !inPlace {
+			script += fmt.Sprintf("%s\n", getExtractCommandForSource(context.Sources[0], *unpackQuietly, "%{buildsubdir}"))
 		}
 
-		if !*createDir {
+		if !*createDir || inPlace {
 			script += "cd %{buildsubdir}\n"
 		} else if !*skipDefaultSource {
-			script += fmt.Sprintf("%s\n", getExtractCommandForName(context.Sources[0].URL, *unpackQuietly))
+			script += fmt.Sprintf("%s\n", getExtractCommandForSource(context.Sources[0], *unpackQuietly, "."))
 		}
 
 		for _, source := range context.Sources[1:] {
-			script += fmt.Sprintf("%s\n", getExtractCommandForName(source.URL, *unpackQuietly))
+			script += fmt.Sprintf("%s\n", getExtractCommandForSource(source, *unpackQuietly, "."))
 		}
 
 		mutate = script
@@ -53,9 +53,24 @@ func outputWarning(message string) {
 	println(yellow("WARNING ==> ") + bold(message))
 }
 
+var exitHooks []func()
+
+// atExit registers a function to run when alpmbuild exits because of an
+// error.
+func atExit(hook func()) {
+	exitHooks = append(exitHooks, hook)
+}
+
+func exit(code int) {
+	for index := len(exitHooks) - 1; index >= 0; index-- {
+		exitHooks[index]()
+	}
+	os.Exit(code)
+}
+
 func outputError(message string) {
 	println(red("ERROR ==> ") + bold(message))
-	os.Exit(1)
+	exit(1)
 }
 
 func outputErrorHighlight(message, lineToHighlight, additionalMessage string, startIndex, length int) {
@@ -76,13 +91,10 @@ func outputErrorHighlight(message, lineToHighlight, additionalMessage string, st
 			bold(additionalMessage),
 		)
 	}
-	os.Exit(1)
+	exit(1)
 }
 
 func outputWarningHighlight(message, lineToHighlight, additionalMessage string, startIndex, length int) {
-	if *fakeroot {
-		return
-	}
 	if len(lineToHighlight) < startIndex+length {
 		return
 	}
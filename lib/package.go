@@ -1,13 +1,15 @@
 package lib
 
 import (
-	"bufio"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -16,6 +18,12 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/appadeia/alpmbuild/lib/libalpm"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
 )
 
 /*
@@ -92,29 +100,36 @@ var PossibleKeys = []string{
 var PossibleDirectives = []string{
 	"NoFileCheck",
 	"ReasonFor",
+	"Options",
 }
 
 type CompressionType struct {
 	Suffix string
 	Flag   string
+	// Compressor compresses its standard input to its standard output.
+	Compressor []string
 }
 
 var CompressionTypes = map[string]CompressionType{
 	"gz": CompressionType{
-		Suffix: "gz",
-		Flag:   "-z",
+		Suffix:     "gz",
+		Flag:       "-z",
+		Compressor: []string{"gzip", "-c", "-f", "-n"},
 	},
 	"xz": CompressionType{
-		Suffix: "xz",
-		Flag:   "-J",
+		Suffix:     "xz",
+		Flag:       "-J",
+		Compressor: []string{"xz", "-c", "-z", "-"},
 	},
 	"zstd": CompressionType{
-		Suffix: "zst",
-		Flag:   "--zstd",
+		Suffix:     "zst",
+		Flag:       "--zstd",
+		Compressor: []string{"zstd", "-c", "-z", "-q", "-"},
 	},
 	"bz2": CompressionType{
-		Suffix: "bz2",
-		Flag:   "-j",
+		Suffix:     "bz2",
+		Flag:       "-j",
+		Compressor: []string{"bzip2", "-c", "-f"},
 	},
 }
 
@@ -129,6 +144,24 @@ var packageFields = []string{
 	"checkrequires:",
 }
 
+// requirementFields are the packageFields that name packages that have to
+// be in the repositories.
+var requirementFields = []string{
+	"requires:",
+	"recommends:",
+	"buildrequires:",
+	"checkrequires:",
+}
+
+func isRequirement(field string) bool {
+	for _, requirementField := range requirementFields {
+		if field == requirementField {
+			return true
+		}
+	}
+	return false
+}
+
 type HashType int
 
 const (
@@ -141,18 +174,69 @@ const (
 	Md5Hash
 )
 
-var hashTypes = []string{
-	"sha1",
-	"sha224",
-	"sha256",
-	"sha384",
-	"sha512",
-	"md5",
-	"sig",
-	"key",
-	"keyserver",
+// checksumAlgorithm is a digest that can follow "with" on a Source or Patch
+// line. Field is the Source field holding the expected value.
+type checksumAlgorithm struct {
+	Name  string
+	Field string
+	New   func() hash.Hash
+}
+
+// newBlake2b512 returns an unkeyed BLAKE2b-512 hash, which is what b2sum
+// computes.
+func newBlake2b512() hash.Hash {
+	h, _ := blake2b.New512(nil)
+	return h
 }
 
+// checksumAlgorithms lists every supported digest, strongest first.
+var checksumAlgorithms = []checksumAlgorithm{
+	{"b2", "B2", newBlake2b512},
+	{"sha3-512", "Sha3_512", sha3.New512},
+	{"sha512", "Sha512", sha512.New},
+	{"sha3-384", "Sha3_384", sha3.New384},
+	{"sha384", "Sha384", sha512.New384},
+	{"sha3-256", "Sha3_256", sha3.New256},
+	{"sha256", "Sha256", sha256.New},
+	{"sha3-224", "Sha3_224", sha3.New224},
+	{"sha224", "Sha224", sha256.New224},
+	{"sha1", "Sha1", sha1.New},
+	{"md5", "Md5", md5.New},
+}
+
+func lookupChecksumAlgorithm(name string) (checksumAlgorithm, bool) {
+	for _, algorithm := range checksumAlgorithms {
+		if algorithm.Name == name {
+			return algorithm, true
+		}
+	}
+	return checksumAlgorithm{}, false
+}
+
+// validChecksum reports whether value looks like a digest of algorithm:
+// as many hexadecimal digits as the algorithm has.
+func validChecksum(algorithm checksumAlgorithm, value string) bool {
+	if len(value) != algorithm.New().Size()*2 {
+		return false
+	}
+	for _, digit := range strings.ToLower(value) {
+		if !strings.ContainsRune("0123456789abcdef", digit) {
+			return false
+		}
+	}
+	return true
+}
+
+func checksumNames() []string {
+	var names []string
+	for _, algorithm := range checksumAlgorithms {
+		names = append(names, algorithm.Name)
+	}
+	return names
+}
+
+var hashTypes = append(checksumNames(), "sig", "key", "mirror")
+
 type Source struct {
 	URL             string
 	Rename          string
@@ -162,9 +246,39 @@ type Source struct {
 	Sha224          string
 	Sha384          string
 	Sha512          string
+	Sha3_224        string
+	Sha3_256        string
+	Sha3_384        string
+	Sha3_512        string
+	B2              string
 	GPGSignatureURL string
 	GPGKeys         []string
-	GPGKeyservers   []string
+	Mirrors         []string
+	// Revision is the commit a VCS source was checked out at.
+	Revision string `json:",omitempty"`
+	// Line is the line of the specfile the source was declared on, counting
+	// from zero. A source continued over several lines is on the first.
+	Line int `json:"-"`
+}
+
+// checksum returns the expected digest declared for algorithm, if any.
+func (source Source) checksum(algorithm checksumAlgorithm) string {
+	return reflect.ValueOf(source).FieldByName(algorithm.Field).String()
+}
+
+func (source *Source) setChecksum(algorithm checksumAlgorithm, value string) {
+	reflect.ValueOf(source).Elem().FieldByName(algorithm.Field).SetString(value)
+}
+
+// fileName is the name the source has in the build directory.
+func (source Source) fileName() string {
+	if source.Rename != "" {
+		return source.Rename
+	}
+	if vcs, ok := source.vcs(); ok {
+		return vcs.name()
+	}
+	return path.Base(source.URL)
 }
 
 type PackageContext struct {
@@ -204,6 +318,14 @@ type PackageContext struct {
 		Install []string
 		Check   []string
 	}
+	// CommandLines are the lines of the specfile each of the commands is
+	// on, counting from one.
+	CommandLines struct {
+		Prepare []int
+		Build   []int
+		Install []int
+		Check   []int
+	}
 
 	// Scriptlet fields
 	Scriptlets struct {
@@ -220,6 +342,18 @@ type PackageContext struct {
 	parentPackage *PackageContext
 	Subpackages   map[string]PackageContext
 	Reasons       map[string]string
+	// buildsubdir is the directory %setup -n unpacks the sources into, in
+	// the build directory. It is empty if %setup didn't name one.
+	buildsubdir string
+}
+
+// buildSubdirectory is the directory in the build directory that %setup
+// unpacks the sources into, and that the sections after %prep run in.
+func (pkg PackageContext) buildSubdirectory() string {
+	if pkg.buildsubdir != "" {
+		return pkg.buildsubdir
+	}
+	return pkg.Name + "-" + pkg.Version
 }
 
 func (pkg PackageContext) GetNevra() string {
@@ -240,16 +374,7 @@ func (pkg PackageContext) GetNevr() string {
 
 func (pkg PackageContext) GeneratePackageInfo() {
 	outputStatus("Generating package info for " + highlight(pkg.GetNevra()) + "...")
-	home, err := os.UserHomeDir()
-	if err != nil {
-		outputError(fmt.Sprintf("Failed to generate pkginfo:\n%s", err.Error()))
-	}
-	pkgdir := ""
-	if !pkg.IsSubpackage {
-		pkgdir = filepath.Join(home, "alpmbuild/package")
-	} else {
-		pkgdir = filepath.Join(home, "alpmbuild/subpackages", pkg.GetNevra())
-	}
+	pkgdir := pkg.PackageRoot()
 	os.Chdir(pkgdir)
 
 	packageInfo := "# Generated by alpmbuild"
@@ -283,7 +408,7 @@ func (pkg PackageContext) GeneratePackageInfo() {
 
 					for _, item := range keyArray {
 						if packageInfoKey == "optdepend" {
-							if reason, ok := pkg.Reasons[item]; ok {
+							if reason, ok := pkg.Reasons[libalpm.ParseDepend(item).Name]; ok {
 								packageInfo = fmt.Sprintf("%s\n%s = %s: %s", packageInfo, packageInfoKey, item, reason)
 							} else {
 								packageInfo = fmt.Sprintf("%s\n%s = %s", packageInfo, packageInfoKey, item)
@@ -315,7 +440,7 @@ func (pkg PackageContext) GeneratePackageInfo() {
 
 	packageInfo = fmt.Sprintf("%s\narch = %s", packageInfo, unameString)
 
-	err = ioutil.WriteFile(filepath.Join(pkgdir, ".PKGINFO"), []byte(packageInfo), 0644)
+	err := ioutil.WriteFile(filepath.Join(pkgdir, ".PKGINFO"), []byte(packageInfo), 0644)
 	if err != nil {
 		outputError(fmt.Sprintf("Failed to generate pkginfo:\n%s", err.Error()))
 	}
@@ -363,42 +488,24 @@ func (pkg PackageContext) GenerateINSTALL() {
 
 func (pkg PackageContext) GenerateMTree() {
 	outputStatus("Generating .MTREE for " + highlight(pkg.GetNevra()) + "...")
-	home, err := os.UserHomeDir()
-	if err != nil {
-		outputError(fmt.Sprintf("Failed to generate mtree:\n%s", err.Error()))
-	}
-	if !pkg.IsSubpackage {
-		os.Chdir(filepath.Join(home, "alpmbuild/package"))
-	} else {
-		os.Chdir(filepath.Join(home, "alpmbuild/subpackages", pkg.GetNevra()))
+	files, err := pkg.packageFiles()
+	if err == nil {
+		var mtree *os.File
+		mtree, err = os.Create(filepath.Join(pkg.PackageRoot(), ".MTREE"))
+		if err == nil {
+			err = writeMTree(pkg.PackageRoot(), files, mtree)
+			mtree.Close()
+		}
 	}
-
-	cmd := exec.Command("sh", "-c", `LANG=C bsdtar -c -f - --format=mtree \
-	--options='!all,use-set,type,uid,gid,mode,time,size,md5,sha256,link' \
-	--null --exclude .MTREE * | gzip -c -f -n > .MTREE`)
-	output, err := cmd.CombinedOutput()
 	if err != nil {
-		outputError(fmt.Sprintf("Failed to generate mtree:\n%s", string(output)))
+		outputError("Failed to generate mtree: " + err.Error())
 	}
 }
 
 func setupDirectories() error {
-	if !*fakeroot {
-		outputStatus("Setting up directories...")
-	}
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return err
-	}
-
-	for _, dir := range []string{"alpmbuild/buildroot", "alpmbuild/package", "alpmbuild/sources", "alpmbuild/packages", "alpmbuild/subpackages", "alpmbuild/sourcepackages"} {
-		err = os.MkdirAll(filepath.Join(home, dir), os.ModePerm)
-		if dir == "alpmbuild/sourcepackages" ||
-			dir == "alpmbuild/package" ||
-			dir == "alpmbuild/subpackages" {
-			os.RemoveAll(filepath.Join(home, dir))
-			err = os.MkdirAll(filepath.Join(home, dir), os.ModePerm)
-		}
+	outputStatus("Setting up directories...")
+	for _, dir := range []string{directories.Build, directories.BuildRoot, directories.Sources, directories.Output, directories.Subpackages, directories.SourcePackages} {
+		err := os.MkdirAll(dir, os.ModePerm)
 		if err != nil {
 			return err
 		}
@@ -407,112 +514,106 @@ func setupDirectories() error {
 	return nil
 }
 
-func (pkg PackageContext) setupSources() error {
-	if !*fakeroot {
-		outputStatus("Verifiying sources...")
+// checksum is a digest declared for a source, along with the hash that
+// computes it.
+type checksum struct {
+	Name     string
+	Expected string
+	Hash     hash.Hash
+}
+
+// checksums returns a fresh hash for every checksum declared for source.
+func (source Source) checksums() []checksum {
+	var sums []checksum
+	for _, algorithm := range checksumAlgorithms {
+		if expected := source.checksum(algorithm); expected != "" {
+			sums = append(sums, checksum{algorithm.Name, expected, algorithm.New()})
+		}
 	}
-	home, err := os.UserHomeDir()
+	return sums
+}
+
+// hashFile feeds the contents of file to every writer in a single read.
+func hashFile(file string, writers ...io.Writer) error {
+	data, err := os.Open(file)
 	if err != nil {
 		return err
 	}
+	defer data.Close()
+	_, err = io.Copy(io.MultiWriter(writers...), data)
+	return err
+}
+
+// verifySourceChecksums checks file against every checksum declared for
+// source. All of the digests are computed while reading the file once.
+func verifySourceChecksums(source Source, file string) error {
+	sums := source.checksums()
+	if len(sums) == 0 {
+		return nil
+	}
+
+	var names []string
+	var writers []io.Writer
+	for _, sum := range sums {
+		names = append(names, sum.Name)
+		writers = append(writers, sum.Hash)
+	}
+	outputStatus(fmt.Sprintf("Checking %s integrity of %s...", strings.Join(names, ", "), highlight(source.fileName())))
+
+	err := hashFile(file, writers...)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for _, sum := range sums {
+		actual := hex.EncodeToString(sum.Hash.Sum(nil))
+		if !strings.EqualFold(actual, sum.Expected) {
+			failures = append(failures, fmt.Sprintf(
+				"%s checksum failure for %s: expected %s, but got %s",
+				sum.Name,
+				highlight(source.fileName()),
+				highlight(sum.Expected),
+				highlight(actual),
+			))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "\n\t"))
+	}
+	return nil
+}
 
-	handleSource := func(source Source) error {
-		target := filepath.Join(home, "alpmbuild/buildroot", path.Base(source.URL))
-		if source.Rename != "" {
-			target = filepath.Join(home, "alpmbuild/buildroot", source.Rename)
+func (pkg PackageContext) setupSources() error {
+	outputStatus("Verifiying sources...")
+	cache := defaultSourceCache()
+
+	handleSource := func(source *Source) error {
+		target := filepath.Join(directories.Build, source.fileName())
+		if _, ok := source.vcs(); ok {
+			revision, err := cache.fetchVCS(*source, target)
+			source.Revision = revision
+			return err
 		}
 		if isValidUrl(source.URL) {
-			if !*fakeroot {
-				outputStatus("Downloading " + highlight(source.URL) + "...")
-			}
-			err := downloadFile(filepath.Join(home, "alpmbuild/sources", path.Base(source.URL)), source.URL)
+			cached, err := cache.fetch(*source)
 			if err != nil {
 				return err
 			}
-			if source.Rename != "" && !*fakeroot {
+			if source.Rename != "" {
 				outputStatus(fmt.Sprintf("Renaming %s to %s...", highlight(path.Base(source.URL)), highlight(source.Rename)))
 			}
-			_, err = copyFile(filepath.Join(home, "alpmbuild/sources", path.Base(source.URL)), target)
+			// Sources are copied out of the cache, as %prep may change them.
+			err = cloneFile(cached, target)
 			if err != nil {
 				return err
 			}
-			data, err := ioutil.ReadFile(filepath.Join(home, "alpmbuild/sources", path.Base(source.URL)))
-			if err != nil {
-				return err
-			}
-			badChecksum := func(filename, expected, actual string) {
-				outputError(
-					fmt.Sprintf(
-						"Checksum failure for %s: expected %s, but got %s",
-						highlight(filename),
-						highlight(expected),
-						highlight(actual),
-					),
-				)
-			}
-			if source.Sha1 != "" {
-				if !*fakeroot {
-					outputStatus("Checking sha1 integrity of " + path.Base(target) + "...")
-				}
-				sum := sha1.Sum(data)
-				if hex.EncodeToString(sum[:]) != source.Sha1 {
-					badChecksum(path.Base(target), source.Sha1, hex.EncodeToString(sum[:]))
-				}
-			}
-			if source.Sha224 != "" {
-				if !*fakeroot {
-					outputStatus("Checking sha224 integrity of " + highlight(path.Base(target)) + "...")
-				}
-				sum := sha256.Sum224(data)
-				if hex.EncodeToString(sum[:]) != source.Sha224 {
-					badChecksum(path.Base(target), source.Sha1, hex.EncodeToString(sum[:]))
-				}
-			}
-			if source.Sha256 != "" {
-				if !*fakeroot {
-					outputStatus("Checking sha256 integrity of " + highlight(path.Base(target)) + "...")
-				}
-				sum := sha256.Sum256(data)
-				if hex.EncodeToString(sum[:]) != source.Sha256 {
-					badChecksum(path.Base(target), source.Sha256, hex.EncodeToString(sum[:]))
-				}
-			}
-			if source.Sha384 != "" {
-				if !*fakeroot {
-					outputStatus("Checking sha384 integrity of " + highlight(path.Base(target)) + "...")
-				}
-				sum := sha512.Sum384(data)
-				if hex.EncodeToString(sum[:]) != source.Sha384 {
-					badChecksum(path.Base(target), source.Sha384, hex.EncodeToString(sum[:]))
-				}
-			}
-			if source.Sha512 != "" {
-				if !*fakeroot {
-					outputStatus("Checking sha512 integrity of " + highlight(path.Base(target)) + "...")
-				}
-				sum := sha512.Sum512(data)
-				if hex.EncodeToString(sum[:]) != source.Sha512 {
-					badChecksum(path.Base(target), source.Sha512, hex.EncodeToString(sum[:]))
-				}
-			}
-			if source.Md5 != "" {
-				if !*fakeroot {
-					outputStatus("Checking md5 integrity of " + highlight(path.Base(target)) + "...")
-				}
-				sum := md5.Sum(data)
-				if hex.EncodeToString(sum[:]) != source.Md5 {
-					badChecksum(path.Base(target), source.Md5, hex.EncodeToString(sum[:]))
-				}
-			}
 		} else {
-			if !*fakeroot {
-				outputStatus("Downloading " + highlight(source.URL) + "...")
-			}
 			outputStatus("Copying " + highlight(source.URL) + " to build directory...")
-			if source.Rename != "" && !*fakeroot {
+			if source.Rename != "" {
 				outputStatus(fmt.Sprintf("Renaming %s to %s...", highlight(path.Base(source.URL)), highlight(source.Rename)))
 			}
-			_, err := copyFile(filepath.Join(home, "alpmbuild/sources", source.URL), filepath.Join(home, "alpmbuild/buildroot", target))
+			_, err := copyFile(filepath.Join(directories.Sources, source.URL), target)
 			if err != nil {
 				return err
 			}
@@ -520,127 +621,154 @@ func (pkg PackageContext) setupSources() error {
 		return nil
 	}
 
-	for _, source := range append(pkg.Sources, pkg.Patches...) {
+	sources := append(append([]Source{}, pkg.Sources...), pkg.Patches...)
+
+	var keyring openpgp.EntityList
+	for _, source := range sources {
+		if source.GPGSignatureURL != "" {
+			var err error
+			keyring, err = loadSpecKeyring()
+			if err != nil {
+				return fmt.Errorf("cannot verify signed sources: %s", err.Error())
+			}
+			break
+		}
+	}
+
+	handleSignedSource := func(source *Source) error {
 		err := handleSource(source)
+		if err != nil || source.GPGSignatureURL == "" {
+			return err
+		}
+		err = handleSource(&Source{
+			URL: source.GPGSignatureURL,
+		})
 		if err != nil {
 			return err
 		}
-		if source.GPGSignatureURL != "" {
-			err = handleSource(Source{
-				URL: source.GPGSignatureURL,
-			})
-			if err != nil {
-				return err
-			}
-			hasKey := func(key string) bool {
-				cmd := exec.Command("gpg", "--list-keys", "0x"+key)
-				cmd.Run()
-				return cmd.ProcessState.ExitCode() == 0
-			}
-			handleSig := func(key, server string) {
-				println(bold("  Do you want to try importing the key with ID ") + highlight(key) + bold(" from keyserver ") + highlight(server))
-				println(bold("  [y/N]"))
-				println()
-				print("  " + bold("-> "))
+		baseSource := source.fileName()
+		baseSignat := path.Base(source.GPGSignatureURL)
+		outputStatus(
+			fmt.Sprintf(
+				"Verifying the signature of source file %s for package %s...",
+				highlight(baseSource),
+				highlight(pkg.GetNevra()),
+			),
+		)
+		err = verifySourceSignature(
+			keyring,
+			*source,
+			filepath.Join(directories.Build, baseSource),
+			filepath.Join(directories.Build, baseSignat),
+		)
+		if err != nil {
+			return fmt.Errorf(
+				"Failed to verify the signature of source file %s for package %s: %s",
+				highlight(baseSource),
+				highlight(pkg.GetNevra()),
+				err.Error(),
+			)
+		}
+		return nil
+	}
 
-				reader := bufio.NewReader(os.Stdin)
+	// Sources are fetched by a fixed number of workers. Every source is
+	// attempted even if another one fails, so that all of the problems
+	// can be reported at once.
+	jobs := *downloadJobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	if jobs > 1 && len(sources) > 1 {
+		// Progress bars of simultaneous downloads would overwrite each other.
+		cache.downloader.Progress = nil
+	}
 
-				text, _ := reader.ReadString('\n')
+	errs := make([]error, len(sources))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < jobs; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range queue {
+				errs[index] = handleSignedSource(&sources[index])
+			}
+		}()
+	}
+	for index := range sources {
+		queue <- index
+	}
+	close(queue)
+	wg.Wait()
 
-				if strings.Contains(strings.ToLower(text), "y") {
-					cmd := exec.Command("gpg", "--keyserver", server, "--recv-keys", key)
-					cmd.Run()
-					if cmd.ProcessState.ExitCode() != 0 {
-						outputWarning("Failed to import GPG key")
-					}
-				}
+	// Record the revisions VCS sources were checked out at, so that they
+	// end up in the build info.
+	for index := range pkg.Sources {
+		pkg.Sources[index].Revision = sources[index].Revision
+	}
+	for index := range pkg.Patches {
+		pkg.Patches[index].Revision = sources[len(pkg.Sources)+index].Revision
+	}
 
-				println()
-			}
-			for _, keyserver := range source.GPGKeyservers {
-				for _, key := range source.GPGKeys {
-					if !*fakeroot {
-						if !hasKey(key) {
-							handleSig(key, keyserver)
-						}
-					}
-				}
-			}
-			baseSource := path.Base(source.URL)
-			baseSignat := path.Base(source.GPGSignatureURL)
-			if !*fakeroot {
-				cmd := exec.Command("gpg", "--verify", filepath.Join(home, "alpmbuild/buildroot", baseSignat), filepath.Join(home, "alpmbuild/buildroot", baseSource))
-				outputStatus(
-					fmt.Sprintf(
-						"Verifiying of the source file %s for package %s...",
-						highlight(baseSource),
-						highlight(pkg.GetNevra()),
-					),
-				)
-				cmd.Run()
-				if cmd.ProcessState.ExitCode() != 0 {
-					outputError(
-						fmt.Sprintf(
-							"Failed to verify the signature of source file %s for package %s",
-							highlight(baseSource),
-							highlight(pkg.GetNevra()),
-						),
-					)
-				}
-			}
+	var failures []string
+	var missing []string
+	for index, err := range errs {
+		var notOffline *offlineError
+		if errors.As(err, &notOffline) {
+			missing = append(missing, highlight(notOffline.URL))
+		} else if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", highlight(sources[index].URL), err.Error()))
 		}
 	}
+	if len(missing) > 0 {
+		failures = append(failures, "These sources are needed but can't be downloaded offline:\n\t\t"+strings.Join(missing, "\n\t\t"))
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "\n\t"))
+	}
 
 	return nil
 }
 
 func (pkg PackageContext) PackageRoot() string {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		outputError("Could not get user's home directory.")
-	}
-
 	if !pkg.IsSubpackage {
-		return filepath.Join(home, "alpmbuild/package")
+		return directories.BuildRoot
 	}
-	return filepath.Join(home, "alpmbuild/subpackages", pkg.GetNevra())
+	return filepath.Join(directories.Subpackages, pkg.GetNevra())
 }
 
 func (pkg PackageContext) CompressPackage() {
 	outputStatus("Compressing " + highlight(pkg.GetNevra()) + " into a package...")
-	home, err := os.UserHomeDir()
-	if err != nil {
-		outputError("Could not get user's home directory.")
-	}
-	packagesDir := filepath.Join(home, "alpmbuild/packages")
 	os.Chdir(pkg.PackageRoot())
 
-	clean := exec.Command("find", ".", "-type", "d", "-empty", "-delete")
-	clean.Run()
-
-	cmd := exec.Command("sh", "-c", "shopt -s dotglob; bsdtar "+CompressionTypes[*compressionType].Flag+" -cvf"+packagesDir+"/"+pkg.GetNevra()+".pkg.tar."+CompressionTypes[*compressionType].Suffix+" .PKGINFO .MTREE *")
-	output, err := cmd.CombinedOutput()
+	files, err := pkg.packageFiles()
+	if err != nil {
+		outputError("Creating tarball failed: " + err.Error())
+	}
+	output, err := os.Create(filepath.Join(directories.Output, pkg.GetNevra()+".pkg.tar."+CompressionTypes[*compressionType].Suffix))
 	if err != nil {
-		outputError(fmt.Sprintf("Creating tarball failed:\n%s", string(output)))
+		outputError("Creating tarball failed: " + err.Error())
+	}
+	defer output.Close()
+	pipe, wait, err := compressTo(output)
+	if err == nil {
+		err = writeArchive(pkg.PackageRoot(), files, pipe)
+		pipe.Close()
+		if waitErr := wait(); err == nil {
+			err = waitErr
+		}
+	}
+	if err != nil {
+		outputError("Creating tarball failed: " + err.Error())
 	}
 }
 
 func (pkg PackageContext) VerifyFiles() {
 	outputStatus("Checking files of " + highlight(pkg.GetNevra()) + "...")
-	home, err := os.UserHomeDir()
-	if err != nil {
-		outputError("Could not get user's home directory.")
-	}
-
-	pathToWalk := ""
+	pathToWalk := pkg.PackageRoot()
 
-	if !pkg.IsSubpackage {
-		pathToWalk = filepath.Join(home, "alpmbuild/package")
-	} else {
-		pathToWalk = filepath.Join(home, "alpmbuild/subpackages", pkg.GetNevra())
-	}
-
-	err = filepath.Walk(
+	err := filepath.Walk(
 		pathToWalk,
 		func(path string, info os.FileInfo, err error) error {
 			if err != nil {
@@ -657,7 +785,7 @@ func (pkg PackageContext) VerifyFiles() {
 				return nil
 			}
 			hasMatch := false
-			for _, listedFile := range pkg.Files {
+			for _, listedFile := range pkg.filePaths() {
 				regexString := strings.ReplaceAll(listedFile, "/", "\\/")
 				regexString = strings.ReplaceAll(listedFile, ".", "\\.")
 				regexString = strings.ReplaceAll(regexString, "*", ".*")
@@ -670,7 +798,7 @@ func (pkg PackageContext) VerifyFiles() {
 				}
 			}
 			for _, subpackage := range pkg.Subpackages {
-				for _, listedFile := range subpackage.Files {
+				for _, listedFile := range subpackage.filePaths() {
 					regexString := strings.ReplaceAll(listedFile, "/", "\\/")
 					regexString = strings.ReplaceAll(listedFile, ".", "\\.")
 					regexString = strings.ReplaceAll(regexString, "*", ".*")
@@ -697,11 +825,7 @@ func (pkg PackageContext) VerifyFiles() {
 
 func (pkg PackageContext) ClearTimestamps() {
 	outputStatus("Cleaning up timestamps...")
-	home, err := os.UserHomeDir()
-	if err != nil {
-		outputError("Could not get user's home directory.")
-	}
-	path := filepath.Join(home, "alpmbuild/package")
+	path := pkg.PackageRoot()
 	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
 		cmd := exec.Command("touch", "-d", "@1", path)
 		cmd.Run()
@@ -711,21 +835,17 @@ func (pkg PackageContext) ClearTimestamps() {
 
 func (pkg PackageContext) TakeFilesFromParent() {
 	outputStatus("Moving files from " + highlight(pkg.parentPackage.Name) + " to " + highlight(pkg.GetNevra()) + "...")
-	home, err := os.UserHomeDir()
-	if err != nil {
-		outputError("Could not get user's home directory.")
-	}
-	path := filepath.Join(home, "alpmbuild/subpackages", pkg.GetNevra())
+	path := pkg.PackageRoot()
 	os.MkdirAll(path, os.ModePerm)
 
-	for _, file := range pkg.Files {
-		globPath := filepath.Join(home, "alpmbuild/package", file)
+	for _, file := range pkg.filePaths() {
+		globPath := filepath.Join(directories.BuildRoot, file)
 		files, err := filepath.Glob(globPath)
 		if err != nil {
 			outputError("Bad globbing: " + err.Error())
 		}
 		for _, fileToCopy := range files {
-			fromPackageRootPath := strings.TrimPrefix(fileToCopy, filepath.Join(home, "alpmbuild/package"))
+			fromPackageRootPath := strings.TrimPrefix(fileToCopy, directories.BuildRoot)
 			dirName, _ := filepath.Split(fromPackageRootPath)
 			os.MkdirAll(filepath.Join(path, dirName), os.ModePerm)
 			err = os.Rename(fileToCopy, filepath.Join(path, fromPackageRootPath))
@@ -738,37 +858,29 @@ func (pkg PackageContext) TakeFilesFromParent() {
 
 func (pkg PackageContext) GenerateSourcePackage() {
 	outputStatus("Generating source package...")
-	home, err := os.UserHomeDir()
+	staging := filepath.Join(directories.SourcePackages, pkg.GetNevr())
+	err := os.MkdirAll(staging, os.ModePerm)
 	if err != nil {
-		outputError("There was an error obtaining the home directory")
+		outputError("Failed to set up source package directory: " + err.Error())
 	}
 	for _, source := range pkg.Sources {
 		if !isValidUrl(source.URL) {
-			_, err := copyFile(filepath.Join(home, "alpmbuild/sources", source.URL), filepath.Join(home, "alpmbuild/sourcepackages", source.URL))
+			_, err := copyFile(filepath.Join(directories.Sources, source.URL), filepath.Join(staging, source.URL))
 			if err != nil {
 				outputError("There was an error copying sources into the source package")
 			}
 		}
 	}
 	os.Chdir(startPWD)
-	_, err = copyFile(*buildFile, filepath.Join(home, "alpmbuild/sourcepackages", path.Base(*buildFile)))
+	_, err = copyFile(*buildFile, filepath.Join(staging, path.Base(*buildFile)))
 	if err != nil {
 		outputError("There was an error copying the specfile into the source package:\n\t" + err.Error())
 	}
-	os.Chdir(filepath.Join(home, "alpmbuild"))
-	err = os.RemoveAll(filepath.Join(home, "alpmbuild", pkg.GetNevr()))
-	if err != nil {
-		outputError("Failed to clean up source package directory: " + err.Error())
-	}
-	err = os.Rename(filepath.Join(home, "alpmbuild/sourcepackages"), filepath.Join(home, "alpmbuild", pkg.GetNevr()))
-	if err != nil {
-		outputError("Failed to rename source package directory: " + err.Error())
-	}
-	err = exec.Command("bsdtar", CompressionTypes[*compressionType].Flag, "-cvf", filepath.Join(home, "alpmbuild", "packages", pkg.GetNevr()+".alpmsrc.pkg.tar."+CompressionTypes[*compressionType].Suffix), pkg.GetNevr()).Run()
+	err = exec.Command("bsdtar", CompressionTypes[*compressionType].Flag, "-C", directories.SourcePackages, "-cvf", filepath.Join(directories.Output, pkg.GetNevr()+".alpmsrc.pkg.tar."+CompressionTypes[*compressionType].Suffix), pkg.GetNevr()).Run()
 	if err != nil {
 		outputError("Failed to compress source package: " + err.Error())
 	}
-	err = os.RemoveAll(filepath.Join(home, "alpmbuild", pkg.GetNevr()))
+	err = os.RemoveAll(staging)
 	if err != nil {
 		outputError("Failed to clean up source package directory: " + err.Error())
 	}
@@ -814,88 +926,91 @@ func (pkg PackageContext) CheckArch() {
 	)
 }
 
-func (pkg PackageContext) BuildPackage() {
+// BuildPackage runs the steps of the build plan. %install runs as root in
+// a user namespace or under fakeroot; everything else runs as the user.
+func (pkg PackageContext) BuildPackage(tree *buildTree) {
 	pkg.CheckArch()
-	if !*fakeroot {
-		outputStatus("Building package " + highlight(pkg.GetNevra()) + "...")
-	}
+	outputStatus("Building package " + highlight(pkg.GetNevra()) + "...")
 	err := setupDirectories()
 	if err != nil {
 		outputError(fmt.Sprintf("Error setting up directories:\n\t%s", err.Error()))
 	}
-	err = pkg.setupSources()
-	if err != nil {
-		outputError(fmt.Sprintf("Error setting up sources:\n\t%s", err.Error()))
+	if plan.runs(prepStep) {
+		err = pkg.setupSources()
+		if err != nil {
+			outputError(fmt.Sprintf("Error setting up sources:\n\t%s", err.Error()))
+		}
+		err = tree.saveRevisions(pkg)
+	} else {
+		err = tree.loadRevisions(&pkg)
 	}
-
-	home, err := os.UserHomeDir()
 	if err != nil {
-		outputError("Could not get user's home directory.")
+		outputError("Failed to record the revisions of sources: " + err.Error())
 	}
 
-	os.Chdir(filepath.Join(home, "alpmbuild/buildroot"))
-
-	env := os.Environ()
-	env = append(env, fmt.Sprintf("BUILDROOT=%s", filepath.Join(home, "alpmbuild/package")))
-
-	// Prepare commands.
-	var commands []string
-	var installCommands []string
+	if *cleanChrootBuild && plan.To >= plan.From {
+		tree.chroot, err = setupCleanChroot(tree, pkg.buildDependencies())
+		if err != nil {
+			outputError("Failed to set up a clean chroot: " + err.Error())
+		}
+	}
 
-	commands = append(commands, pkg.Commands.Prepare...)
-	commands = append(commands, pkg.Commands.Build...)
-	commands = append(commands, pkg.Commands.Check...)
-	installCommands = append(installCommands, pkg.Commands.Install...)
+	os.Chdir(directories.Build)
 
-	path, err := writeTempfile(strings.Join(commands, "\n"))
-	if err != nil {
-		outputError("There was an error preparing a temporary file.")
+	// A failing section leaves its build tree behind, so that the log and
+	// the half-built sources can be looked at.
+	runSection := func(section string, commands []string, lines []int, asRoot bool) {
+		err := pkg.runSection(tree, section, commands, lines, asRoot)
+		if err != nil {
+			tree.keep = true
+			outputError(err.Error())
+		}
 	}
 
-	installPath, err := writeTempfile(strings.Join(installCommands, "\n"))
-	if err != nil {
-		outputError("There was an error preparing a temporary file.")
+	if plan.runs(prepStep) {
+		runSection("%prep", pkg.Commands.Prepare, pkg.CommandLines.Prepare, false)
 	}
-
-	var pathToUse string
-	if *fakeroot {
-		pathToUse = installPath
-	} else {
-		pathToUse = path
+	if plan.runs(compileStep) {
+		runSection("%build", pkg.Commands.Build, pkg.CommandLines.Build, false)
 	}
-
-	cmd := exec.Command("sh", pathToUse)
-	cmd.Env = env
-
-	if !*hideCommandOutput {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+	if plan.checks() {
+		runSection("%check", pkg.Commands.Check, pkg.CommandLines.Check, false)
+	} else if plan.runs(installStep) && len(pkg.Commands.Check) > 0 {
+		outputStatus("Skipping " + highlight("%check") + "...")
 	}
 
-	if !*fakeroot {
-		outputStatus("Building...")
-	}
-	err = cmd.Run()
-	if err != nil {
-		outputError("Exit status was non-zero in build script, aborting...")
+	if plan.runs(installStep) {
+		// Like rpmbuild, install into an empty buildroot, so that files from
+		// an earlier run of %install don't end up in the package.
+		for _, dir := range []string{directories.BuildRoot, directories.Subpackages} {
+			err = os.RemoveAll(dir)
+			if err == nil {
+				err = os.MkdirAll(dir, os.ModePerm)
+			}
+			if err != nil {
+				outputError("Failed to clean up the buildroot: " + err.Error())
+			}
+		}
+		runSection("%install", pkg.Commands.Install, pkg.CommandLines.Install, true)
 	}
 
-	if !*fakeroot {
-		os.Chdir(initialWorking)
-		cmd := exec.Command("fakeroot", append(os.Args, "-fakeroot")...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Run()
+	if !plan.runs(packageStep) {
+		if plan.Source {
+			pkg.GenerateSourcePackage()
+		}
 		return
 	}
 
 	outputStatus("Running package commands...")
 
+	debug, hasDebug := pkg.strip()
 	pkg.ClearTimestamps()
 
 	for _, subpackage := range pkg.Subpackages {
 		subpackage.InheritFromParent()
 		subpackage.TakeFilesFromParent()
+		subpackage.tidy()
+		subpackage.ClearTimestamps()
 		subpackage.lintAll()
 		subpackage.GenerateINSTALL()
 		subpackage.GenerateCHANGELOG()
@@ -906,6 +1021,18 @@ func (pkg PackageContext) BuildPackage() {
 		subpackage.VerifyFiles()
 	}
 
+	if hasDebug {
+		debug.tidy()
+		debug.ClearTimestamps()
+		debug.lintAll()
+		debug.GeneratePackageInfo()
+		debug.GenerateBuildInfo()
+		debug.GenerateMTree()
+		debug.CompressPackage()
+	}
+
+	pkg.tidy()
+	pkg.ClearTimestamps()
 	pkg.lintAll()
 	pkg.GenerateINSTALL()
 	pkg.GenerateCHANGELOG()
@@ -917,7 +1044,7 @@ func (pkg PackageContext) BuildPackage() {
 	if *checkFiles {
 		pkg.VerifyFiles()
 	}
-	if *generateSourcePackage {
+	if plan.Source {
 		pkg.GenerateSourcePackage()
 	}
 }
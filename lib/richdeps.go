@@ -0,0 +1,219 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/appadeia/alpmbuild/lib/libalpm"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Rich dependencies are rpm's boolean dependencies, such as
+//
+//	Requires: (pipewire-pulse or pulseaudio)
+//	Requires: (gtk3 if xorg-server)
+//
+// pacman only has plain dependencies and optional ones, so they are
+// translated into those where they can be:
+//
+//	(a and b), (a with b)  depend on a and b
+//	(a or b)               depend on a, and optionally on the others
+//	(a if b)               optionally depend on a for use with b; when
+//	                       building, depend on a if b is installed
+//
+// The others, else, unless and without, have no translation.
+
+// richDependency is a rich dependency. It is either a plain dependency, or
+// Operator applied to Operands.
+type richDependency struct {
+	Dependency string
+	Operator   string
+	Operands   []*richDependency
+}
+
+// optionalDependency is a dependency that goes into the optional
+// dependencies of a package, along with why.
+type optionalDependency struct {
+	Dependency string
+	Reason     string
+}
+
+var richOperators = []string{"and", "or", "if", "else", "with", "without", "unless"}
+
+func isRichOperator(word string) bool {
+	for _, operator := range richOperators {
+		if word == operator {
+			return true
+		}
+	}
+	return false
+}
+
+func (rich *richDependency) String() string {
+	if rich.Operator == "" {
+		return rich.Dependency
+	}
+	var operands []string
+	for _, operand := range rich.Operands {
+		operands = append(operands, operand.String())
+	}
+	operator := rich.Operator
+	if strings.HasSuffix(operator, " else") {
+		return "(" + operands[0] + " " + strings.TrimSuffix(operator, " else") + " " + operands[1] + " else " + operands[2] + ")"
+	}
+	return "(" + strings.Join(operands, " "+operator+" ") + ")"
+}
+
+// parseRichDependency parses the rich dependency at the start of words,
+// which starts with a parenthesis, and returns the words after it.
+func parseRichDependency(words []string) (*richDependency, []string, error) {
+	if len(words) == 0 || words[0] != "(" {
+		return nil, nil, errors.New("unmatched " + highlight(")"))
+	}
+	words = words[1:]
+	rich := &richDependency{}
+	var operators []string
+	for {
+		var operand *richDependency
+		var err error
+		if len(words) > 0 && words[0] == "(" {
+			operand, words, err = parseRichDependency(words)
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			end := 0
+			for end < len(words) && words[end] != "(" && words[end] != ")" && !isRichOperator(words[end]) {
+				end++
+			}
+			if end == 0 {
+				if len(words) == 0 {
+					return nil, nil, errors.New("unmatched " + highlight("("))
+				}
+				return nil, nil, fmt.Errorf("expected a dependency instead of %s", highlight(words[0]))
+			}
+			dependencies, err := parseDependencies(words[:end])
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(dependencies) != 1 {
+				return nil, nil, fmt.Errorf("%s are more than one dependency in a rich dependency", highlight(strings.Join(words[:end], " ")))
+			}
+			operand = &richDependency{Dependency: dependencies[0]}
+			words = words[end:]
+		}
+		rich.Operands = append(rich.Operands, operand)
+
+		if len(words) == 0 {
+			return nil, nil, errors.New("unmatched " + highlight("("))
+		}
+		if words[0] == ")" {
+			words = words[1:]
+			break
+		}
+		operators = append(operators, words[0])
+		words = words[1:]
+	}
+
+	switch {
+	case len(operators) == 0:
+		return rich.Operands[0], words, nil
+	case len(operators) == 2 && (operators[0] == "if" || operators[0] == "unless") && operators[1] == "else":
+		rich.Operator = operators[0] + " else"
+		return rich, words, nil
+	}
+	for _, operator := range operators {
+		if operator != operators[0] {
+			return nil, nil, fmt.Errorf("%s and %s can't be mixed without parentheses", highlight(operators[0]), highlight(operator))
+		}
+	}
+	if len(operators) > 1 && operators[0] != "and" && operators[0] != "or" && operators[0] != "with" {
+		return nil, nil, fmt.Errorf("%s can only be used once without parentheses", highlight(operators[0]))
+	}
+	rich.Operator = operators[0]
+	return rich, words, nil
+}
+
+// translate turns a rich dependency of the field into dependencies and
+// optional dependencies. Build dependencies can't be optional, so
+// conditional build dependencies are decided by what is installed now.
+func (rich *richDependency) translate(field string) ([]string, []optionalDependency, error) {
+	build := field == "buildrequires:" || field == "checkrequires:"
+	if !build && field != "requires:" && field != "recommends:" {
+		return nil, nil, fmt.Errorf("rich dependency %s can't be used in %s", highlight(rich.String()), highlight(strings.Title(field)))
+	}
+	if rich.Operator == "" {
+		return translateDependency(rich.Dependency), nil, nil
+	}
+
+	var dependencies [][]string
+	var optional []optionalDependency
+	for _, operand := range rich.Operands {
+		translated, translatedOptional, err := operand.translate(field)
+		if err != nil {
+			return nil, nil, err
+		}
+		dependencies = append(dependencies, translated)
+		optional = append(optional, translatedOptional...)
+	}
+
+	switch rich.Operator {
+	case "and", "with":
+		var all []string
+		for _, operand := range dependencies {
+			all = append(all, operand...)
+		}
+		return all, optional, nil
+	case "or":
+		// The first alternative is always the one depended on, so that the
+		// package doesn't depend on what the machine it's built on has.
+		if build {
+			return dependencies[0], optional, nil
+		}
+		for _, operand := range dependencies[1:] {
+			for _, dep := range operand {
+				optional = append(optional, optionalDependency{dep, "alternative to " + strings.Join(dependencies[0], ", ")})
+			}
+		}
+		return dependencies[0], optional, nil
+	case "if":
+		if rich.Operands[1].Operator != "" {
+			break
+		}
+		condition := dependencies[1]
+		if build {
+			installed := true
+			for _, dep := range condition {
+				installed = installed && libalpm.PackageInstalled(dep)
+			}
+			if installed {
+				return dependencies[0], optional, nil
+			}
+			return nil, optional, nil
+		}
+		for _, dep := range dependencies[0] {
+			optional = append(optional, optionalDependency{dep, "for use with " + strings.Join(condition, ", ")})
+		}
+		return nil, optional, nil
+	}
+	return nil, nil, fmt.Errorf("rich dependency %s uses %s, which pacman has no way to express", highlight(rich.String()), highlight(rich.Operator))
+}
@@ -0,0 +1,228 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Every script section of a specfile (%prep, %build, %check and %install)
+// runs as a script of its own. The script starts with a preamble like rpm's
+// %___build_pre, which stops at the first failing command and remembers
+// which line it was on.
+
+// shellQuote quotes s for use as a single word in a shell script.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// sectionPreamble is the start of the script of a section. failedLine is
+// the file the line number of a failing command is written to.
+func (pkg PackageContext) sectionPreamble(section, failedLine string) string {
+	lines := []string{
+		"#!/bin/bash",
+		"# " + section + " of " + pkg.GetNevra() + ", run by alpmbuild",
+		"set -e",
+		"umask 022",
+		"trap 'echo $LINENO > " + shellQuote(failedLine) + "' ERR",
+		"cd " + shellQuote(directories.Build),
+	}
+	// %prep creates the build subdirectory; the other sections start in it.
+	if section != "%prep" {
+		subdir := shellQuote(filepath.Join(directories.Build, pkg.buildSubdirectory()))
+		lines = append(lines, "if [ -d "+subdir+" ]; then cd "+subdir+"; fi")
+	}
+	lines = append(lines,
+		"export BUILDROOT="+shellQuote(directories.BuildRoot),
+		"export RPM_BUILD_ROOT="+shellQuote(directories.BuildRoot),
+	)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// sectionError describes a section that failed.
+type sectionError struct {
+	Section  string
+	ExitCode int
+	Duration time.Duration
+	// ScriptLine is the line of the script the failing command is on,
+	// counting from the first command, and Command is that line of the
+	// script, after macros were expanded. Line is the line of the specfile
+	// the command came from. Either is zero if it isn't known.
+	Script     string
+	ScriptLine int
+	Line       int
+	Command    string
+	Log        string
+}
+
+func (err *sectionError) Error() string {
+	message := fmt.Sprintf("%s failed with exit code %d after %s", highlight(err.Section), err.ExitCode, err.Duration.Round(time.Millisecond))
+	switch {
+	case err.Line > 0:
+		message += fmt.Sprintf(" on line %d of the specfile:\n\t%s", err.Line, strings.TrimSpace(err.Command))
+	case err.ScriptLine > 0:
+		message += fmt.Sprintf(" on line %d of the commands in %s:\n\t%s", err.ScriptLine, highlight(err.Script), strings.TrimSpace(err.Command))
+	}
+	message += "\nThe full output is in " + highlight(err.Log)
+	if err.Section == "%check" {
+		message += "\nThe package built, but its tests failed. Use " + highlight("-nocheck") + " to build it without running them."
+	}
+	return message
+}
+
+// logs is the directory the output of sections is saved to.
+func (tree *buildTree) logs() string {
+	return filepath.Join(tree.Record, "logs")
+}
+
+// startAsRoot starts cmd as root in a user namespace that maps root to the
+// user, like unshare --map-root-user, falling back to fakeroot where user
+// namespaces aren't allowed. Either way, the files cmd creates really belong
+// to the user; what they belong to in the package is up to %attr and
+// %defattr. Only root is mapped, so install -o or chown to other users
+// fails in %install, and those files need an %attr instead.
+func startAsRoot(cmd *exec.Cmd) (*exec.Cmd, error) {
+	if os.Getuid() == 0 {
+		return cmd, cmd.Start()
+	}
+	asNamespaceRoot(cmd, 0)
+	err := cmd.Start()
+	if err == nil {
+		return cmd, nil
+	}
+
+	fakeroot, lookErr := exec.LookPath("fakeroot")
+	if lookErr != nil {
+		return cmd, fmt.Errorf("could not create a user namespace (%s), and %s is not installed", err.Error(), highlight("fakeroot"))
+	}
+	outputWarning("Could not create a user namespace (" + err.Error() + "), using " + highlight("fakeroot") + " instead...")
+	fallback := exec.Command(fakeroot, append([]string{"--", cmd.Path}, cmd.Args[1:]...)...)
+	fallback.Dir = cmd.Dir
+	fallback.Env = cmd.Env
+	fallback.Stdout = cmd.Stdout
+	fallback.Stderr = cmd.Stderr
+	return fallback, fallback.Start()
+}
+
+// runSection runs the commands of a section of the specfile, such as
+// %build, as a stage of the build. Its output is saved to a log in the
+// build tree. lines are the lines of the specfile the commands are on, for
+// reporting which of them failed. asRoot runs the section with startAsRoot.
+func (pkg PackageContext) runSection(tree *buildTree, section string, commands []string, lines []int, asRoot bool) error {
+	if len(commands) == 0 {
+		return nil
+	}
+	name := strings.TrimPrefix(section, "%")
+
+	failedLine := filepath.Join(tree.scripts(), name+".failed")
+	os.Remove(failedLine)
+	preamble := pkg.sectionPreamble(section, failedLine)
+	body := strings.Join(commands, "\n")
+	path, err := tree.writeScript(name, preamble+body+"\n")
+	if err != nil {
+		return fmt.Errorf("could not write the script of %s: %s", section, err.Error())
+	}
+
+	err = os.MkdirAll(tree.logs(), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	logPath := filepath.Join(tree.logs(), name+".log")
+	log, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	cmd := exec.Command("bash", path)
+	cmd.Env = buildEnvironment(pkg.Name)
+	if tree.chroot != nil {
+		cmd = tree.chroot.command(tree, path, cmd.Env)
+	}
+	if *hideCommandOutput {
+		cmd.Stdout = log
+		cmd.Stderr = log
+	} else {
+		cmd.Stdout = io.MultiWriter(os.Stdout, log)
+		cmd.Stderr = io.MultiWriter(os.Stderr, log)
+	}
+
+	outputStatus("Running " + highlight(section) + "...")
+	start := time.Now()
+	// Sections in a clean chroot always run as root in a user namespace
+	// of their own.
+	switch {
+	case tree.chroot != nil:
+		err = tree.chroot.start(cmd)
+	case asRoot:
+		cmd, err = startAsRoot(cmd)
+	default:
+		err = cmd.Start()
+	}
+	if err != nil {
+		return fmt.Errorf("could not run %s: %s", section, err.Error())
+	}
+	err = cmd.Wait()
+	duration := time.Since(start)
+	if err == nil {
+		outputStatus(fmt.Sprintf("%s finished in %s", highlight(section), duration.Round(time.Millisecond)))
+		return nil
+	}
+
+	failure := &sectionError{
+		Section:  section,
+		ExitCode: -1,
+		Duration: duration,
+		Script:   path,
+		Log:      logPath,
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		failure.ExitCode = exitErr.ExitCode()
+	}
+	if data, err := ioutil.ReadFile(failedLine); err == nil {
+		line, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		bodyLines := strings.Split(body, "\n")
+		line -= strings.Count(preamble, "\n")
+		if err == nil && line > 0 && line <= len(bodyLines) {
+			failure.ScriptLine = line
+			failure.Command = bodyLines[line-1]
+			// Macros such as %setup expand to several lines, so find the
+			// command the line of the script is part of.
+			for i, command := range commands {
+				line -= strings.Count(command, "\n") + 1
+				if line <= 0 {
+					if i < len(lines) {
+						failure.Line = lines[i]
+					}
+					break
+				}
+			}
+		}
+	}
+	return failure
+}
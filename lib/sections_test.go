@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunSection(t *testing.T) {
+	if hideCommandOutput == nil {
+		hideCommandOutput = new(bool)
+	}
+	*hideCommandOutput = true
+	defer func() { *hideCommandOutput = false }()
+
+	top := t.TempDir()
+	saved := directories
+	defer func() { directories = saved }()
+	directories = buildDirectories{
+		Top:            top,
+		Build:          filepath.Join(top, "buildroot"),
+		BuildRoot:      filepath.Join(top, "package"),
+		Subpackages:    filepath.Join(top, "subpackages"),
+		SourcePackages: filepath.Join(top, "sourcepackages"),
+	}
+	tree, err := newBuildTree("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.lock.Close()
+	if err := tree.enter(); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg := PackageContext{Name: "hello", Version: "1.0"}
+	err = pkg.runSection(tree, "%build", []string{
+		"echo building in $PWD",
+		"test -n \"$BUILDROOT\"\ncd .",
+		"sh -c 'exit 3'",
+		"echo unreachable",
+	}, []int{10, 12, 13, 14}, false)
+	var failure *sectionError
+	if !errors.As(err, &failure) {
+		t.Fatalf("expected the section to fail, got %v", err)
+	}
+	if failure.ExitCode != 3 || failure.ScriptLine != 4 || failure.Line != 13 || failure.Command != "sh -c 'exit 3'" {
+		t.Errorf("unexpected failure %+v", failure)
+	}
+	log, err := ioutil.ReadFile(failure.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), "building in "+directories.Build) || strings.Contains(string(log), "unreachable") {
+		t.Errorf("unexpected log:\n%s", log)
+	}
+
+	if err := pkg.runSection(tree, "%check", []string{"true"}, nil, false); err != nil {
+		t.Errorf("a passing section failed: %v", err)
+	}
+}
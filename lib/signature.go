@@ -0,0 +1,226 @@
+package lib
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// specKeyringDirectory is where the public keys for a spec's signed
+// sources are kept, relative to the spec.
+const specKeyringDirectory = "keys/pgp"
+
+// loadSpecKeyring reads the keys checked in next to the specfile. Only
+// these keys are trusted; the user's own GnuPG keyring is never consulted.
+func loadSpecKeyring() (openpgp.EntityList, error) {
+	dir := filepath.Join(specDirectory(), specKeyringDirectory)
+	keyring, err := loadKeyringDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("no public keys found in %s", dir)
+	}
+	return keyring, nil
+}
+
+// loadKeyringDir reads every armored key in the *.asc files of dir.
+func loadKeyringDir(dir string) (openpgp.EntityList, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.asc"))
+	if err != nil {
+		return nil, err
+	}
+	var keyring openpgp.EntityList
+	for _, file := range files {
+		data, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := openpgp.ReadArmoredKeyRing(data)
+		data.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filepath.Base(file), err.Error())
+		}
+		keyring = append(keyring, keys...)
+	}
+	return keyring, nil
+}
+
+// weakSignatureHashes are the hashes that signatures can be forged for,
+// so signatures made with them aren't trusted.
+var weakSignatureHashes = map[crypto.Hash]string{
+	crypto.MD5:       "MD5",
+	crypto.SHA1:      "SHA-1",
+	crypto.RIPEMD160: "RIPEMD-160",
+}
+
+// readSignatures reads the signatures of a detached signature file, which
+// may be armored or binary, and may hold more than one signature.
+func readSignatures(signaturePath string) ([]*packet.Signature, error) {
+	data, err := ioutil.ReadFile(signaturePath)
+	if err != nil {
+		return nil, err
+	}
+	var reader io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP")) {
+		block, err := armor.Decode(reader)
+		if err != nil {
+			return nil, err
+		}
+		reader = block.Body
+	}
+	var signatures []*packet.Signature
+	packets := packet.NewReader(reader)
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		signature, ok := p.(*packet.Signature)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a detached signature", filepath.Base(signaturePath))
+		}
+		signatures = append(signatures, signature)
+	}
+	if len(signatures) == 0 {
+		return nil, fmt.Errorf("no signatures found in %s", filepath.Base(signaturePath))
+	}
+	return signatures, nil
+}
+
+// signingKey is the key that made a signature, and the fingerprints it
+// can be expected by: its own, and that of its primary key if it is a
+// subkey.
+type signingKey struct {
+	Entity       *openpgp.Entity
+	Fingerprints []string
+}
+
+func (key signingKey) String() string {
+	name := key.Fingerprints[0]
+	if identity := key.Entity.PrimaryIdentity(); identity != nil {
+		name += " (" + identity.Name + ")"
+	}
+	return name
+}
+
+// verifySignature checks a single signature of data against keyring.
+func verifySignature(keyring openpgp.EntityList, data io.ReadSeeker, signature *packet.Signature) (signingKey, error) {
+	if name, weak := weakSignatureHashes[signature.Hash]; weak {
+		return signingKey{}, fmt.Errorf("signature uses %s, which is too weak to be trusted", name)
+	}
+	var serialized bytes.Buffer
+	if err := signature.Serialize(&serialized); err != nil {
+		return signingKey{}, err
+	}
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		return signingKey{}, err
+	}
+	_, entity, err := openpgp.VerifyDetachedSignature(keyring, data, &serialized, nil)
+	if err != nil {
+		if signature.IssuerKeyId != nil {
+			return signingKey{}, fmt.Errorf("%s (key %016X)", err.Error(), *signature.IssuerKeyId)
+		}
+		return signingKey{}, err
+	}
+	key := signingKey{Entity: entity, Fingerprints: []string{fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)}}
+	for _, subkey := range entity.Subkeys {
+		if signature.IssuerKeyId != nil && subkey.PublicKey.KeyId == *signature.IssuerKeyId {
+			key.Fingerprints = append([]string{fmt.Sprintf("%X", subkey.PublicKey.Fingerprint)}, key.Fingerprints...)
+		}
+	}
+	return key, nil
+}
+
+// normaliseKeyID turns the ways people write fingerprints into the
+// uppercase hexadecimal form they are compared in.
+func normaliseKeyID(id string) string {
+	id = strings.ToUpper(strings.TrimPrefix(strings.TrimPrefix(id, "0x"), "0X"))
+	return strings.Replace(id, " ", "", -1)
+}
+
+func keyMatches(key signingKey, fingerprint string) bool {
+	for _, candidate := range key.Fingerprints {
+		if candidate == normaliseKeyID(fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySourceSignature checks the detached signature of a source against
+// the spec's keyring. Every signature in the file has to be valid. If the
+// source lists keys with "with key", one of the signatures has to come
+// from one of them. Keys are given by their fingerprints, as key IDs can
+// be forged.
+func verifySourceSignature(keyring openpgp.EntityList, source Source, sourcePath, signaturePath string) error {
+	for _, id := range source.GPGKeys {
+		if len(normaliseKeyID(id)) != 40 {
+			return fmt.Errorf("%s is not a full fingerprint", id)
+		}
+	}
+
+	signatures, err := readSignatures(signaturePath)
+	if err != nil {
+		return err
+	}
+	data, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	var signers []signingKey
+	for _, signature := range signatures {
+		signer, err := verifySignature(keyring, data, signature)
+		if err != nil {
+			return err
+		}
+		signers = append(signers, signer)
+	}
+
+	if len(source.GPGKeys) == 0 {
+		return nil
+	}
+	var names []string
+	for _, signer := range signers {
+		for _, id := range source.GPGKeys {
+			if keyMatches(signer, id) {
+				return nil
+			}
+		}
+		names = append(names, signer.String())
+	}
+	return fmt.Errorf("signed by %s, which is not one of the expected keys: %s", strings.Join(names, " and "), strings.Join(source.GPGKeys, ", "))
+}
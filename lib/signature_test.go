@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+var pgpTestdata = filepath.Join("testdata", "pgp")
+
+func TestLoadKeyringDir(t *testing.T) {
+	keyring, err := loadKeyringDir(pgpTestdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyring) != 3 {
+		t.Errorf("expected 3 keys, got %d", len(keyring))
+	}
+}
+
+func TestVerifySourceSignature(t *testing.T) {
+	keyring, err := loadKeyringDir(pgpTestdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(pgpTestdata, "data.txt")
+	rsa := "A0BC4136337A9FAA989B8FAA42037D30CBABEE81"
+	ed25519 := "F9D0FA1B0EF3D48CC99996E93DBD79B2D0D7060F"
+
+	for _, test := range []struct {
+		signature string
+		keys      []string
+		failure   string
+	}{
+		{"data.txt.rsa.sig", nil, ""},
+		{"data.txt.rsa.sig", []string{ed25519, rsa}, ""},
+		{"data.txt.rsa.sig", []string{ed25519}, "not one of the expected keys"},
+		{"data.txt.rsa.sig", []string{rsa[24:]}, "not a full fingerprint"},
+		// The ed25519 key signs with a subkey, and is expected by the
+		// fingerprint of its primary key.
+		{"data.txt.ed25519.sig", []string{ed25519}, ""},
+		// The expected key made the second signature.
+		{"data.txt.both.sig", []string{rsa}, ""},
+		{"data.txt.expired.sig", nil, "expired"},
+	} {
+		source := Source{URL: data, GPGKeys: test.keys}
+		err := verifySourceSignature(keyring, source, data, filepath.Join(pgpTestdata, test.signature))
+		if test.failure == "" && err != nil {
+			t.Errorf("%s with keys %v failed: %s", test.signature, test.keys, err)
+		}
+		if test.failure != "" && (err == nil || !strings.Contains(err.Error(), test.failure)) {
+			t.Errorf("%s with keys %v failed with %v, expected %q", test.signature, test.keys, err, test.failure)
+		}
+	}
+}
+
+func TestVerifyTamperedSource(t *testing.T) {
+	keyring, err := loadKeyringDir(pgpTestdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := filepath.Join(t.TempDir(), "data.txt")
+	if err := ioutil.WriteFile(tampered, []byte("goodbye alpmbuild\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySourceSignature(keyring, Source{URL: tampered}, tampered, filepath.Join(pgpTestdata, "data.txt.rsa.sig")); err == nil {
+		t.Errorf("a tampered source was accepted")
+	}
+}
+
+func TestVerifyUnknownSigner(t *testing.T) {
+	keys, err := os.Open(filepath.Join(pgpTestdata, "rsa.asc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+	keyring, err := openpgp.ReadArmoredKeyRing(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(pgpTestdata, "data.txt")
+	if err := verifySourceSignature(keyring, Source{URL: data}, data, filepath.Join(pgpTestdata, "data.txt.ed25519.sig")); err == nil {
+		t.Errorf("a signature by a key outside the keyring was accepted")
+	}
+}
+
+func TestVerifyWeakSignature(t *testing.T) {
+	weak := filepath.Join(pgpTestdata, "weak")
+	keyring, err := loadKeyringDir(weak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(pgpTestdata, "data.txt")
+	err = verifySourceSignature(keyring, Source{URL: data}, data, filepath.Join(weak, "data.txt.sha1.sig"))
+	if err == nil || !strings.Contains(err.Error(), "too weak") {
+		t.Errorf("a SHA-1 signature was accepted: %v", err)
+	}
+}
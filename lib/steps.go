@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// buildStep is a step of a build, in the sense of rpmbuild's -b flags.
+// Steps always run in this order.
+type buildStep int
+
+const (
+	// prepStep unpacks and patches the sources (%prep).
+	prepStep buildStep = iota
+	// compileStep builds them (%build).
+	compileStep
+	// installStep tests them and installs them into the buildroot
+	// (%check and %install).
+	installStep
+	// packageStep turns the buildroot into binary packages.
+	packageStep
+)
+
+// buildPlan describes which steps a build runs and what it produces.
+type buildPlan struct {
+	// From and To are the first and last step to run. A plan that only
+	// builds a source package runs no steps, and has To before From.
+	From buildStep
+	To   buildStep
+	// Source tells whether a source package is made.
+	Source bool
+	// Mode is the rpmbuild flag that selected the plan, if any.
+	Mode string
+	// Check tells whether %check runs along with %install.
+	Check bool
+}
+
+// runs reports whether the plan includes step.
+func (plan buildPlan) runs(step buildStep) bool {
+	return step >= plan.From && step <= plan.To
+}
+
+// checks reports whether the plan runs %check.
+func (plan buildPlan) checks() bool {
+	return plan.Check && plan.runs(installStep)
+}
+
+// stopsEarly reports whether the build ends before there is a binary
+// package, in which case the build tree is what it leaves behind.
+func (plan buildPlan) stopsEarly() bool {
+	return plan.To < packageStep && plan.To >= plan.From
+}
+
+// plan is the plan of the build. Without any of the -b flags, alpmbuild
+// builds everything.
+var plan = buildPlan{From: prepStep, To: packageStep, Check: true}
+
+// buildModes are rpmbuild's step selection flags. Each takes the specfile
+// to build and builds it up to the given step.
+var buildModes = []struct {
+	Flag   string
+	To     buildStep
+	Source bool
+	Usage  string
+}{
+	{"bp", prepStep, false, "Build the specfile up to and including %prep, like rpmbuild -bp."},
+	{"bc", compileStep, false, "Build the specfile up to and including %build, like rpmbuild -bc."},
+	{"bi", installStep, false, "Build the specfile up to and including %install, like rpmbuild -bi."},
+	{"bb", packageStep, false, "Build binary packages from the specfile, like rpmbuild -bb."},
+	{"bs", prepStep - 1, true, "Build a source package from the specfile, like rpmbuild -bs."},
+	{"ba", packageStep, true, "Build binary and source packages from the specfile, like rpmbuild -ba."},
+}
+
+var buildModeFlags = map[string]*string{}
+var shortCircuit *bool
+var check *bool
+var noCheck *bool
+
+func defineStepFlags() {
+	for _, mode := range buildModes {
+		buildModeFlags[mode.Flag] = flag.String(mode.Flag, "", mode.Usage)
+	}
+	shortCircuit = flag.Bool("short-circuit", false, "Skip straight to the step selected by -bc, -bi or -bb, reusing the build tree of an earlier build.")
+	check = flag.Bool("check", false, "Run %check, even if the configuration says not to.")
+	noCheck = flag.Bool("nocheck", false, "Don't run %check, and don't require the packages it needs.")
+}
+
+// loadBuildPlan works out the build plan from the command line. It returns
+// the specfile named by a -b flag, if one was given.
+func loadBuildPlan() (buildPlan, string) {
+	chosen := buildPlan{
+		From:   prepStep,
+		To:     packageStep,
+		Source: *generateSourcePackage,
+		Check:  true,
+	}
+	specPath := ""
+
+	var used []string
+	for _, mode := range buildModes {
+		if *buildModeFlags[mode.Flag] == "" {
+			continue
+		}
+		used = append(used, "-"+mode.Flag)
+		specPath = *buildModeFlags[mode.Flag]
+		chosen.To = mode.To
+		chosen.Source = mode.Source
+		chosen.Mode = mode.Flag
+	}
+	if len(used) > 1 {
+		outputError("Only one of " + strings.Join(used, ", ") + " can be used at a time.")
+	}
+
+	if *shortCircuit {
+		switch chosen.Mode {
+		case "bc", "bi", "bb":
+			chosen.From = chosen.To
+		default:
+			outputError(highlight("-short-circuit") + " can only be used with " + highlight("-bc") + ", " + highlight("-bi") + " or " + highlight("-bb") + ".")
+		}
+	}
+
+	if *check && *noCheck {
+		outputError("Only one of " + highlight("-check") + " and " + highlight("-nocheck") + " can be used at a time.")
+	}
+	value := ""
+	if *check {
+		value = "true"
+	} else if *noCheck {
+		value = "false"
+	}
+	if value, _ = setting("check", value); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			outputError("The check setting should be " + highlight("true") + " or " + highlight("false") + ", not " + highlight(value) + ".")
+		}
+		chosen.Check = parsed
+	}
+	return chosen, specPath
+}
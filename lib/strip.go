@@ -0,0 +1,332 @@
+package lib
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// After %install, ELF files in the buildroot are stripped like makepkg
+// strips them. With the debug option, their debug info is kept in a
+// <name>-debug package first, along with the sources they were built from.
+// Options come from OPTIONS in makepkg.conf and can be overridden by the
+// specfile, like the options array of a PKGBUILD:
+//
+//	#!alpmbuild Options !strip
+
+// specOptions are the options given by the specfile.
+var specOptions []string
+
+// buildOption reports whether the option name is enabled.
+func buildOption(name string, fallback bool) bool {
+	enabled := fallback
+	for _, options := range [][]string{strings.Fields(makepkgConf["OPTIONS"]), specOptions} {
+		for _, option := range options {
+			if option == name {
+				enabled = true
+			} else if option == "!"+name {
+				enabled = false
+			}
+		}
+	}
+	return enabled
+}
+
+func debugEnabled() bool {
+	return buildOption("strip", true) && buildOption("debug", false)
+}
+
+const (
+	debugDirectory       = "/usr/lib/debug"
+	debugSourceDirectory = "/usr/src/debug"
+)
+
+// debugSources is where the debug package of pkgbase puts the sources it
+// was built from. Like makepkg, each package gets a directory of its own,
+// so that debug packages with sources of the same names don't conflict.
+func debugSources(pkgbase string) string {
+	return filepath.Join(debugSourceDirectory, pkgbase)
+}
+
+// stripFlags returns how to strip the file at path, or nothing if it isn't
+// something that is stripped.
+func stripFlags(path string) []string {
+	flags := func(variable, fallback string) []string {
+		if value, ok := makepkgConf[variable]; ok {
+			return strings.Fields(value)
+		}
+		return []string{fallback}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return nil
+	}
+	if string(magic) == "!<arch>\n" && strings.HasSuffix(path, ".a") {
+		return flags("STRIP_STATIC", "--strip-debug")
+	}
+	if !bytes.HasPrefix(magic, []byte(elf.ELFMAG)) {
+		return nil
+	}
+
+	object, err := elf.NewFile(file)
+	if err != nil {
+		return nil
+	}
+	switch object.Type {
+	case elf.ET_EXEC:
+		return flags("STRIP_BINARIES", "--strip-all")
+	case elf.ET_DYN:
+		// Position independent executables are shared objects too, but
+		// have an interpreter.
+		for _, program := range object.Progs {
+			if program.Type == elf.PT_INTERP {
+				return flags("STRIP_BINARIES", "--strip-all")
+			}
+		}
+		return flags("STRIP_SHARED", "--strip-unneeded")
+	case elf.ET_REL:
+		if strings.HasSuffix(path, ".ko") {
+			return flags("STRIP_SHARED", "--strip-unneeded")
+		}
+	}
+	return nil
+}
+
+// buildID returns the GNU build ID of an ELF file with debug info, which is
+// what debuggers find its debug info by. Files without either get nothing.
+func buildID(path string) string {
+	object, err := elf.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer object.Close()
+	if object.Section(".debug_info") == nil {
+		return ""
+	}
+	note := object.Section(".note.gnu.build-id")
+	if note == nil {
+		return ""
+	}
+	data, err := note.Data()
+	if err != nil || len(data) < 16 {
+		return ""
+	}
+	nameSize := object.ByteOrder.Uint32(data[0:4])
+	descSize := object.ByteOrder.Uint32(data[4:8])
+	if object.ByteOrder.Uint32(data[8:12]) != 3 || nameSize != 4 {
+		return ""
+	}
+	start := 12 + int(nameSize)
+	if start+int(descSize) > len(data) {
+		return ""
+	}
+	return hex.EncodeToString(data[start : start+int(descSize)])
+}
+
+var warnedDebugedit bool
+
+// copyDebugSources rewrites the source paths and compilation directories
+// of the file at path to be in the debugSources of pkgbase, and copies the
+// sources it was built from into the debug package root.
+func copyDebugSources(path, debugRoot, pkgbase string) error {
+	if _, err := exec.LookPath("debugedit"); err != nil {
+		if !warnedDebugedit {
+			outputWarning(highlight("debugedit") + " is not installed, so the debug package won't have the sources of the package.")
+			warnedDebugedit = true
+		}
+		return nil
+	}
+	list, err := ioutil.TempFile("", "alpmbuild-debugedit")
+	if err != nil {
+		return err
+	}
+	list.Close()
+	defer os.Remove(list.Name())
+
+	_, err = runCommand("", "debugedit", "--no-recompute-build-id", "--base-dir", directories.Build, "--dest-dir", debugSources(pkgbase), "--list-file", list.Name(), path)
+	if err != nil {
+		return err
+	}
+	sources, err := ioutil.ReadFile(list.Name())
+	if err != nil {
+		return err
+	}
+	for _, source := range strings.Split(string(sources), "\x00") {
+		from := filepath.Join(directories.Build, source)
+		if info, err := os.Stat(from); source == "" || err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		to := filepath.Join(debugRoot, debugSources(pkgbase), source)
+		err = os.MkdirAll(filepath.Dir(to), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		_, err = copyFile(from, to)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitDebug moves the debug info of the file at relative path in root
+// into debugRoot, and links it to the file by its build ID.
+func splitDebug(root, relative, id, debugRoot, pkgbase string) error {
+	path := filepath.Join(root, relative)
+	err := copyDebugSources(path, debugRoot, pkgbase)
+	if err != nil {
+		return err
+	}
+	debugFile := filepath.Join(debugRoot, debugDirectory, relative+".debug")
+	err = os.MkdirAll(filepath.Dir(debugFile), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err = runCommand("", "objcopy", "--only-keep-debug", path, debugFile)
+	if err != nil {
+		return err
+	}
+	_, err = runCommand("", "objcopy", "--add-gnu-debuglink="+debugFile, path)
+	if err != nil {
+		return err
+	}
+
+	links := filepath.Join(debugRoot, debugDirectory, ".build-id", id[:2])
+	err = os.MkdirAll(links, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	for link, target := range map[string]string{
+		id[2:] + ".debug": "../../" + relative + ".debug",
+		id[2:]:            "../../../../../" + relative,
+	} {
+		os.Remove(filepath.Join(links, link))
+		err = os.Symlink(target, filepath.Join(links, link))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripFiles strips the ELF files in the buildroot. With the debug option,
+// their debug info is moved to the root of the debug package first.
+func (pkg PackageContext) stripFiles(debugRoot string) error {
+	root := directories.BuildRoot
+	debug := debugEnabled()
+	stripped := map[uint64]string{}
+	links := map[string]string{}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, _ := filepath.Rel(root, path)
+		if info.IsDir() && "/"+relative == debugDirectory {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		flags := stripFlags(path)
+		if flags == nil {
+			return nil
+		}
+		// Hard links are stripped once, and linked again afterwards, as
+		// strip replaces the file.
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+			if first, ok := stripped[stat.Ino]; ok {
+				links[path] = first
+				return nil
+			}
+			stripped[stat.Ino] = path
+		}
+
+		if debug {
+			if id := buildID(path); id != "" {
+				err = splitDebug(root, relative, id, debugRoot, pkg.Name)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		_, err = runCommand("", "strip", append(flags, path)...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for link, target := range links {
+		err = os.Remove(link)
+		if err == nil {
+			err = os.Link(target, link)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// debugPackage returns the package the debug info of pkg goes into.
+func (pkg *PackageContext) debugPackage() PackageContext {
+	debug := PackageContext{
+		Name:          pkg.Name + "-debug",
+		Summary:       "Detached debugging symbols for " + pkg.Name,
+		URL:           pkg.URL,
+		IsSubpackage:  true,
+		parentPackage: pkg,
+	}
+	debug.InheritFromParent()
+	return debug
+}
+
+// strip strips the files in the buildroot, if the strip option is on. It
+// returns the debug package if there is debug info to put in one.
+func (pkg *PackageContext) strip() (PackageContext, bool) {
+	debug := pkg.debugPackage()
+	if !buildOption("strip", true) {
+		return debug, false
+	}
+	outputStatus("Stripping unneeded symbols from binaries and libraries...")
+	err := pkg.stripFiles(debug.PackageRoot())
+	if err != nil {
+		outputError("Failed to strip files: " + err.Error())
+	}
+	if _, err := os.Stat(filepath.Join(debug.PackageRoot(), debugDirectory)); err != nil {
+		return debug, false
+	}
+	return debug, true
+}
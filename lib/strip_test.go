@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestStripFiles(t *testing.T) {
+	for _, tool := range []string{"gcc", "strip", "objcopy"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " is not installed")
+		}
+	}
+
+	top := t.TempDir()
+	saved, savedConf, savedOptions := directories, makepkgConf, specOptions
+	defer func() { directories, makepkgConf, specOptions = saved, savedConf, savedOptions }()
+	directories = buildDirectories{
+		Build:       filepath.Join(top, "build"),
+		BuildRoot:   filepath.Join(top, "package"),
+		Subpackages: filepath.Join(top, "subpackages"),
+	}
+	makepkgConf = map[string]string{"OPTIONS": "strip !debug"}
+	specOptions = []string{"debug"}
+
+	bin := filepath.Join(directories.BuildRoot, "usr/bin")
+	os.MkdirAll(bin, os.ModePerm)
+	os.MkdirAll(directories.Build, os.ModePerm)
+	source := filepath.Join(directories.Build, "hello.c")
+	ioutil.WriteFile(source, []byte("int main(void) { return 0; }\n"), 0644)
+	hello := filepath.Join(bin, "hello")
+	output, err := exec.Command("gcc", "-g", "-Wl,--build-id", "-o", hello, source).CombinedOutput()
+	if err != nil {
+		t.Fatalf("gcc failed: %s", output)
+	}
+	os.Link(hello, filepath.Join(bin, "hello-again"))
+	ioutil.WriteFile(filepath.Join(bin, "script"), []byte("#!/bin/sh\n"), 0755)
+
+	if stripFlags(hello) == nil || stripFlags(filepath.Join(bin, "script")) != nil {
+		t.Errorf("files were classified wrongly")
+	}
+	id := buildID(hello)
+	if len(id) < 3 {
+		t.Fatalf("expected a build ID, got %q", id)
+	}
+
+	pkg := PackageContext{Name: "hello", Version: "1.0", Release: "1"}
+	debug, hasDebug := pkg.strip()
+	if !hasDebug || debug.Name != "hello-debug" {
+		t.Fatalf("expected a debug package, got %v %q", hasDebug, debug.Name)
+	}
+	if buildID(hello) != "" {
+		t.Errorf("%s still has debug info", hello)
+	}
+	link := filepath.Join(debug.PackageRoot(), debugDirectory, ".build-id", id[:2], id[2:]+".debug")
+	if _, err := os.Stat(link); err != nil {
+		t.Errorf("the build ID link to the debug info is broken: %v", err)
+	}
+	if !os.SameFile(statFile(t, hello), statFile(t, filepath.Join(bin, "hello-again"))) {
+		t.Errorf("hard links were not kept")
+	}
+}
+
+func statFile(t *testing.T, path string) os.FileInfo {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
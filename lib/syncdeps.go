@@ -0,0 +1,217 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/appadeia/alpmbuild/lib/libalpm"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Missing dependencies are installed with pacman, which runs as root
+// through the elevate setting: sudo, doas or pkexec, whichever is
+// installed, unless alpmbuild runs as root already. Like with makepkg,
+// -syncdeps installs them without asking, -noconfirm never asks anything
+// and -rmdeps removes them again once the build is over.
+
+var syncDeps *bool
+var noConfirm *bool
+var asExplicit *bool
+var removeDeps *bool
+
+func defineDependencyFlags() {
+	syncDeps = flag.Bool("syncdeps", false, "Install missing dependencies with pacman without asking.")
+	flag.BoolVar(syncDeps, "s", false, "Short for -syncdeps.")
+	noConfirm = flag.Bool("noconfirm", false, "Never ask anything. This is passed on to pacman as well.")
+	asExplicit = flag.Bool("asexplicit", false, "Install missing dependencies as explicitly installed packages, rather than as dependencies.")
+	removeDeps = flag.Bool("rmdeps", false, "Remove the dependencies installed for the build once it's over.")
+	flag.BoolVar(removeDeps, "r", false, "Short for -rmdeps.")
+}
+
+// elevationCommands are the commands the elevate setting defaults to, in
+// the order they're looked for.
+var elevationCommands = []string{"sudo", "doas", "pkexec"}
+
+// elevationCommand returns the command that runs pacman as root, which is
+// nothing if alpmbuild runs as root or the elevate setting is none.
+func elevationCommand() ([]string, error) {
+	configured, _ := setting("elevate", "")
+	if configured == "none" || (configured == "" && os.Getuid() == 0) {
+		return nil, nil
+	}
+	if configured != "" {
+		return strings.Fields(configured), nil
+	}
+	for _, command := range elevationCommands {
+		if _, err := exec.LookPath(command); err == nil {
+			return []string{command}, nil
+		}
+	}
+	return nil, errors.New("none of " + strings.Join(elevationCommands, ", ") + " is installed; set " + highlight("elevate") + " to the command that runs pacman as root")
+}
+
+// runPacman runs pacman as root with the elevation command.
+func runPacman(args ...string) error {
+	elevate, err := elevationCommand()
+	if err != nil {
+		return err
+	}
+	if *noConfirm {
+		args = append(args, "--noconfirm")
+	}
+	command := append(append(elevate, "pacman"), args...)
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", strings.Join(command, " "), err.Error())
+	}
+	return nil
+}
+
+// installedPackages returns the names of the installed packages, as they
+// are now.
+func installedPackages() map[string]bool {
+	installed := map[string]bool{}
+	db, err := libalpm.RefreshLocalDatabase()
+	if err != nil {
+		return installed
+	}
+	for _, pkg := range db.Packages {
+		installed[pkg.Name] = true
+	}
+	return installed
+}
+
+// missingDependencies returns the packages to install to build pkg, and
+// the dependencies they are for. The package that satisfies a dependency
+// is listed along with it if it goes by another name.
+func missingDependencies(pkg PackageContext) (targets []string, missing []string) {
+	for _, dep := range pkg.buildDependencies() {
+		if libalpm.PackageInstalled(dep) {
+			continue
+		}
+		if satisfier, ok := libalpm.SyncSatisfier(dep); ok && satisfier.Name != dep {
+			targets = append(targets, satisfier.Name)
+			missing = append(missing, dep+" ("+satisfier.Repository+"/"+satisfier.Name+")")
+		} else {
+			targets = append(targets, dep)
+			missing = append(missing, dep)
+		}
+	}
+	return targets, missing
+}
+
+// askToInstall asks whether to install the missing dependencies, and only
+// returns if they are to be installed.
+func askToInstall(pkg PackageContext, missing []string) {
+	abort := func() {
+		outputError("Cannot build package without dependencies, aborting...")
+	}
+
+	println(red("==>"), highlight(strconv.Itoa(len(missing))), bold("package(s) need installation to build"), highlight(pkg.Name)+bold(":"))
+	println(bold("    Actions: Install (i), List (l), Abort (default: a)"))
+	println()
+	print("  " + bold("-> "))
+
+	reader := bufio.NewReader(os.Stdin)
+	text, err := reader.ReadString('\n')
+	if err != nil {
+		abort()
+	}
+	text = strings.ReplaceAll(text, "\n", "")
+
+	if strings.Contains(text, "i") {
+		return
+	} else if strings.Contains(text, "l") {
+		outputStatus(strings.Join(missing, " "))
+		exit(0)
+	}
+	abort()
+}
+
+// installMissingDependencies installs what is missing to build pkg. It
+// returns what removes the packages it installed with -rmdeps, which does
+// nothing otherwise.
+func installMissingDependencies(pkg PackageContext) func() {
+	nothing := func() {}
+	if *ignoreDeps || *cleanChrootBuild {
+		return nothing
+	}
+	targets, missing := missingDependencies(pkg)
+	if len(targets) == 0 {
+		return nothing
+	}
+	switch {
+	case *syncDeps:
+		outputStatus("Installing missing dependencies: " + highlight(strings.Join(missing, " ")))
+	case *noConfirm:
+		outputError("Missing dependencies: " + highlight(strings.Join(missing, " ")) + "\nUse " + highlight("-syncdeps") + " to install them.")
+	default:
+		askToInstall(pkg, missing)
+	}
+
+	before := installedPackages()
+	// Like makepkg, dependencies are installed as dependencies, so that
+	// pacman -Qdt lists them once nothing needs them anymore.
+	args := []string{"-S"}
+	if !*asExplicit {
+		args = append(args, "--asdeps")
+	}
+	err := runPacman(append(args, targets...)...)
+	if err != nil {
+		outputError("Failed to install dependencies: " + err.Error())
+	}
+
+	var installed []string
+	for name := range installedPackages() {
+		if !before[name] {
+			installed = append(installed, name)
+		}
+	}
+	if !*removeDeps || len(installed) == 0 {
+		return nothing
+	}
+
+	// The dependencies are removed even if the build fails.
+	removed := false
+	remove := func() {
+		if removed {
+			return
+		}
+		removed = true
+		outputStatus("Removing installed dependencies...")
+		err := runPacman(append([]string{"-Rn"}, installed...)...)
+		if err != nil {
+			outputWarning("Failed to remove dependencies: " + err.Error())
+		}
+	}
+	atExit(remove)
+	return remove
+}
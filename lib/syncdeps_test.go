@@ -0,0 +1,22 @@
+package lib
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestElevationCommand(t *testing.T) {
+	defer os.Unsetenv("ALPMBUILD_ELEVATE")
+	for setting, expected := range map[string][]string{
+		"none":                nil,
+		"doas":                {"doas"},
+		"sudo --preserve-env": {"sudo", "--preserve-env"},
+	} {
+		os.Setenv("ALPMBUILD_ELEVATE", setting)
+		command, err := elevationCommand()
+		if err != nil || !reflect.DeepEqual(command, expected) {
+			t.Errorf("elevate = %s gave %q, %v, expected %q", setting, command, err, expected)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package lib
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Before a package is put together, its files are tidied up like makepkg
+// tidies them up. Every step is an option, which is turned on or off by
+// OPTIONS in makepkg.conf or the Options directive of the specfile:
+//
+//	#!alpmbuild Options !zipman staticlibs
+
+// tidyStep is a step of tidying up the root of a package. It runs when
+// Option is RunsIf, which is false for options that keep files, such as
+// staticlibs.
+type tidyStep struct {
+	Option  string
+	Default bool
+	RunsIf  bool
+	Status  string
+	Run     func(root string) error
+}
+
+var tidySteps = []tidyStep{
+	{"purge", true, true, "Purging unwanted files...", purgeTargets},
+	{"libtool", false, false, "Removing libtool files...", removeLibtoolFiles},
+	{"staticlibs", true, false, "Removing static libraries...", removeStaticLibraries},
+	{"zipman", true, true, "Compressing man and info pages...", compressManPages},
+	{"emptydirs", false, false, "Removing empty directories...", removeEmptyDirectories},
+}
+
+// Defaults of makepkg.conf, with the braces expanded.
+const (
+	defaultPurgeTargets = "usr/info/dir usr/share/info/dir .packlist *.pod"
+	defaultManDirs      = "usr/man usr/info usr/share/man usr/share/info usr/local/man usr/local/info usr/local/share/man usr/local/share/info opt/*/man opt/*/info"
+)
+
+// tidy runs the tidy steps that are on over the root of the package.
+func (pkg PackageContext) tidy() {
+	for _, step := range tidySteps {
+		if buildOption(step.Option, step.Default) != step.RunsIf {
+			continue
+		}
+		outputStatus(step.Status)
+		err := step.Run(pkg.PackageRoot())
+		if err != nil {
+			outputError("Failed to tidy up " + highlight(pkg.GetNevra()) + ": " + err.Error())
+		}
+	}
+}
+
+// makepkgList returns the words of a setting of makepkg.conf, or fallback
+// if it isn't set.
+func makepkgList(variable, fallback string) []string {
+	if value, ok := makepkgConf[variable]; ok {
+		return strings.Fields(value)
+	}
+	return strings.Fields(fallback)
+}
+
+// removeMatching removes the files in root whose names match one of the
+// patterns. Directories are left alone.
+func removeMatching(root string, patterns ...string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, info.Name()); matched {
+				return os.Remove(path)
+			}
+		}
+		return nil
+	})
+}
+
+// purgeTargets removes PURGE_TARGETS. Targets with a slash are paths in the
+// package; the others are names of files anywhere in it.
+func purgeTargets(root string) error {
+	var names []string
+	for _, target := range makepkgList("PURGE_TARGETS", defaultPurgeTargets) {
+		if !strings.Contains(target, "/") {
+			names = append(names, target)
+			continue
+		}
+		paths, err := filepath.Glob(filepath.Join(root, target))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			err = os.RemoveAll(path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return removeMatching(root, names...)
+}
+
+func removeLibtoolFiles(root string) error {
+	return removeMatching(root, "*.la")
+}
+
+// removeStaticLibraries removes static libraries that have a shared
+// library next to them.
+func removeStaticLibraries(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".a") {
+			return err
+		}
+		if _, err := os.Lstat(strings.TrimSuffix(path, ".a") + ".so"); err == nil {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// compressedSuffixes are the suffixes of pages that are already compressed.
+var compressedSuffixes = []string{".gz", ".bz2", ".xz", ".zst", ".lz", ".lzma", ".Z"}
+
+// compressManPages gzips the pages in MAN_DIRS. Links to pages are changed
+// to link to the compressed page.
+func compressManPages(root string) error {
+	compressed := map[uint64]string{}
+	for _, pattern := range makepkgList("MAN_DIRS", defaultManDirs) {
+		dirs, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				for _, suffix := range compressedSuffixes {
+					if strings.HasSuffix(path, suffix) {
+						return nil
+					}
+				}
+
+				if info.Mode()&os.ModeSymlink != 0 {
+					target, err := os.Readlink(path)
+					if err != nil {
+						return err
+					}
+					err = os.Symlink(target+".gz", path+".gz")
+					if err != nil {
+						return err
+					}
+					return os.Remove(path)
+				}
+				if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+					if first, ok := compressed[stat.Ino]; ok {
+						err = os.Link(first+".gz", path+".gz")
+						if err != nil {
+							return err
+						}
+						return os.Remove(path)
+					}
+					compressed[stat.Ino] = path
+				}
+				return gzipFile(path, info.Mode())
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gzipFile replaces the file at path with a gzipped copy of it. Like with
+// gzip -n, the name and time of the file aren't recorded.
+func gzipFile(path string, mode os.FileMode) error {
+	input, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	writer, _ := gzip.NewWriterLevel(output, gzip.BestCompression)
+	_, err = io.Copy(writer, input)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = output.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// removeEmptyDirectories removes the empty directories of root, including
+// directories that only contain empty directories.
+func removeEmptyDirectories(root string) error {
+	var dirs []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Children sort after their parents, so they're removed first.
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if entries, err := ioutil.ReadDir(dir); err == nil && len(entries) == 0 {
+			err = os.Remove(dir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTidy(t *testing.T) {
+	top := t.TempDir()
+	saved, savedConf, savedOptions := directories, makepkgConf, specOptions
+	defer func() { directories, makepkgConf, specOptions = saved, savedConf, savedOptions }()
+	directories = buildDirectories{BuildRoot: filepath.Join(top, "package")}
+	makepkgConf = map[string]string{"OPTIONS": "staticlibs"}
+	specOptions = []string{"!staticlibs"}
+
+	root := directories.BuildRoot
+	for path, content := range map[string]string{
+		"usr/share/man/man1/hello.1":   ".TH HELLO 1\n",
+		"usr/share/info/dir":           "",
+		"usr/lib/libhello.so":          "",
+		"usr/lib/libhello.a":           "",
+		"usr/lib/libhello.la":          "",
+		"usr/lib/libother.a":           "",
+		"usr/lib/perl5/perllocal.pod":  "",
+		"usr/share/empty/nested/.keep": "",
+	} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(path)), os.ModePerm)
+		ioutil.WriteFile(filepath.Join(root, path), []byte(content), 0644)
+	}
+	os.Remove(filepath.Join(root, "usr/share/empty/nested/.keep"))
+	os.Symlink("hello.1", filepath.Join(root, "usr/share/man/man1/hi.1"))
+	os.Link(filepath.Join(root, "usr/share/man/man1/hello.1"), filepath.Join(root, "usr/share/man/man1/hey.1"))
+
+	pkg := PackageContext{Name: "hello", Version: "1.0", Release: "1"}
+	pkg.tidy()
+
+	for _, path := range []string{"usr/share/info/dir", "usr/lib/libhello.a", "usr/lib/libhello.la", "usr/lib/perl5/perllocal.pod", "usr/share/empty", "usr/share/man/man1/hello.1"} {
+		if _, err := os.Lstat(filepath.Join(root, path)); err == nil {
+			t.Errorf("%s was not removed", path)
+		}
+	}
+	for _, path := range []string{"usr/lib/libhello.so", "usr/lib/libother.a", "usr/share/man/man1/hi.1.gz", "usr/share/man/man1/hey.1.gz"} {
+		if _, err := os.Stat(filepath.Join(root, path)); err != nil {
+			t.Errorf("%s is missing: %v", path, err)
+		}
+	}
+
+	page, err := os.Open(filepath.Join(root, "usr/share/man/man1/hi.1.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Close()
+	reader, err := gzip.NewReader(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(reader)
+	if string(content) != ".TH HELLO 1\n" || reader.Name != "" {
+		t.Errorf("unexpected page %q named %q", content, reader.Name)
+	}
+}
@@ -0,0 +1,281 @@
+package lib
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// defaultChecksum is added to sources that don't declare any checksum.
+const defaultChecksum = "sha256"
+
+// specLine is a logical line of a specfile, made of one or more physical
+// lines joined by backslash continuations.
+type specLine []string
+
+func splitSpecLines(data string) []specLine {
+	var lines []specLine
+	var current specLine
+	physical := strings.Split(data, "\n")
+	for index, line := range physical {
+		current = append(current, line)
+		if strings.HasSuffix(line, "\\") && index+1 < len(physical) {
+			continue
+		}
+		lines = append(lines, current)
+		current = nil
+	}
+	return lines
+}
+
+// specLineAt returns the index of the logical line that starts on the
+// physical line physical, such as the line of a Source.
+func specLineAt(lines []specLine, physical int) (int, bool) {
+	for index, line := range lines {
+		if physical == 0 {
+			return index, true
+		}
+		physical -= len(line)
+		if physical < 0 {
+			break
+		}
+	}
+	return 0, false
+}
+
+func joinSpecLines(lines []specLine) string {
+	var physical []string
+	for _, line := range lines {
+		physical = append(physical, line...)
+	}
+	return strings.Join(physical, "\n")
+}
+
+// specToken is a word of a logical line, located by the physical line it
+// is on and its byte offsets within that line.
+type specToken struct {
+	Line  int
+	Start int
+	End   int
+	Text  string
+}
+
+var specWordRegex = regexp.MustCompile(`\S+`)
+
+func (line specLine) tokens() []specToken {
+	var tokens []specToken
+	for index, physical := range line {
+		if index+1 < len(line) {
+			physical = strings.TrimSuffix(physical, "\\")
+		}
+		for _, match := range specWordRegex.FindAllStringIndex(physical, -1) {
+			tokens = append(tokens, specToken{
+				Line:  index,
+				Start: match[0],
+				End:   match[1],
+				Text:  physical[match[0]:match[1]],
+			})
+		}
+	}
+	return tokens
+}
+
+// checksumTokens returns the digest token of every "with <algorithm>
+// <digest>" clause on the line, keyed by algorithm name.
+func (line specLine) checksumTokens() map[string]specToken {
+	found := make(map[string]specToken)
+	tokens := line.tokens()
+	for index, token := range tokens {
+		if token.Text != "with" || index+2 >= len(tokens) {
+			continue
+		}
+		if algorithm, ok := lookupChecksumAlgorithm(tokens[index+1].Text); ok {
+			found[algorithm.Name] = tokens[index+2]
+		}
+	}
+	return found
+}
+
+// rewriteChecksums replaces the digests declared on the line with the ones
+// in digests, leaving everything else untouched. If the line declares no
+// checksum at all, a clause for defaultChecksum is appended. It returns how
+// many digests changed. Digests given as macros are left alone.
+func (line specLine) rewriteChecksums(digests map[string]string) int {
+	tokens := line.checksumTokens()
+	if len(tokens) == 0 {
+		last := len(line) - 1
+		line[last] = strings.TrimRight(line[last], " \t") + " with " + defaultChecksum + " " + digests[defaultChecksum]
+		return 1
+	}
+
+	// Replace from the end of the line backwards, so that the offsets of
+	// the tokens still to be replaced stay valid.
+	var names []string
+	for name := range tokens {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := tokens[names[i]], tokens[names[j]]
+		return a.Line > b.Line || (a.Line == b.Line && a.Start > b.Start)
+	})
+
+	changed := 0
+	for _, name := range names {
+		token := tokens[name]
+		if strings.Contains(token.Text, "%") {
+			outputWarning(fmt.Sprintf("The %s checksum %s is a macro and has to be updated by hand", name, highlight(token.Text)))
+			continue
+		}
+		if strings.EqualFold(token.Text, digests[name]) {
+			continue
+		}
+		physical := line[token.Line]
+		line[token.Line] = physical[:token.Start] + digests[name] + physical[token.End:]
+		changed++
+	}
+	return changed
+}
+
+// sourceDigests computes the digest of file for every algorithm named.
+func sourceDigests(file string, names []string) (map[string]string, error) {
+	hashes := make(map[string]hash.Hash)
+	var writers []io.Writer
+	for _, name := range names {
+		algorithm, _ := lookupChecksumAlgorithm(name)
+		hashes[name] = algorithm.New()
+		writers = append(writers, hashes[name])
+	}
+	err := hashFile(file, writers...)
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]string)
+	for name, h := range hashes {
+		digests[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests, nil
+}
+
+// fetchUnverified downloads source into dir without consulting the cache,
+// since the checksums the cache would verify against are the ones being
+// replaced. Local sources are used where they are.
+func fetchUnverified(source Source, dir string, index int) (string, error) {
+	if !isValidUrl(source.URL) {
+		return filepath.Join(directories.Sources, source.URL), nil
+	}
+	outputStatus("Downloading " + highlight(source.URL) + "...")
+	dest := filepath.Join(dir, strconv.Itoa(index))
+	err := newDownloader().download(dest, append([]string{source.URL}, source.Mirrors...)...)
+	return dest, err
+}
+
+// updateChecksums downloads the sources of the specfile at specPath and
+// rewrites their checksums in place.
+func updateChecksums(specPath string) error {
+	data, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(specPath)
+	if err != nil {
+		return err
+	}
+	pkg := ParsePackage(string(data))
+	lines := splitSpecLines(string(data))
+
+	dir, err := ioutil.TempDir("", "alpmbuild-updsums")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	changed := 0
+	var failures []string
+	for index, source := range append(append([]Source{}, pkg.Sources...), pkg.Patches...) {
+		at, ok := specLineAt(lines, source.Line)
+		if !ok {
+			return fmt.Errorf("could not find the line %s was declared on", highlight(source.URL))
+		}
+		if _, ok := source.vcs(); ok {
+			// Checkouts are pinned by their revision instead.
+			continue
+		}
+		line := lines[at]
+
+		names := []string{defaultChecksum}
+		if declared := line.checksumTokens(); len(declared) > 0 {
+			names = nil
+			for name := range declared {
+				names = append(names, name)
+			}
+		}
+
+		file, err := fetchUnverified(source, dir, index)
+		if err == nil {
+			var digests map[string]string
+			digests, err = sourceDigests(file, names)
+			if err == nil {
+				changed += line.rewriteChecksums(digests)
+			}
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", highlight(source.URL), err.Error()))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "\n\t"))
+	}
+
+	if changed == 0 {
+		outputStatus("Checksums in " + highlight(specPath) + " are already up to date")
+		return nil
+	}
+	err = ioutil.WriteFile(specPath, []byte(joinSpecLines(lines)), info.Mode())
+	if err != nil {
+		return err
+	}
+	outputStatus(fmt.Sprintf("Updated %d checksum(s) in %s", changed, highlight(specPath)))
+	return nil
+}
+
+// updsumsCommand implements "alpmbuild updsums", which brings the checksums
+// of every source in the given specfiles up to date.
+func updsumsCommand(args []string) {
+	if len(args) < 1 {
+		outputError("Usage: alpmbuild updsums SPECFILE...")
+	}
+	for _, specPath := range args {
+		err := updateChecksums(specPath)
+		if err != nil {
+			outputError("Failed to update the checksums of " + highlight(specPath) + ":\n\t" + err.Error())
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSpec = `Name: hello
+# The tarball is signed too.
+Source0: https://example.org/hello.tar.gz \
+	with sha256 0000 \
+	with sig https://example.org/hello.tar.gz.sig
+Source1: https://example.org/extra.tar.gz with md5 aaaa with sha1 bbbb
+Patch0: fix.patch   
+`
+
+func TestRewriteChecksums(t *testing.T) {
+	lines := splitSpecLines(testSpec)
+	if len(lines) != 6 {
+		t.Fatalf("expected 6 logical lines, got %d", len(lines))
+	}
+
+	if changed := lines[2].rewriteChecksums(map[string]string{"sha256": "1111"}); changed != 1 {
+		t.Errorf("expected 1 change, got %d", changed)
+	}
+	if changed := lines[3].rewriteChecksums(map[string]string{"md5": "cccccccc", "sha1": "bbbb"}); changed != 1 {
+		t.Errorf("expected 1 change, got %d", changed)
+	}
+	if changed := lines[4].rewriteChecksums(map[string]string{"sha256": "2222"}); changed != 1 {
+		t.Errorf("expected 1 change, got %d", changed)
+	}
+
+	expected := `Name: hello
+# The tarball is signed too.
+Source0: https://example.org/hello.tar.gz \
+	with sha256 1111 \
+	with sig https://example.org/hello.tar.gz.sig
+Source1: https://example.org/extra.tar.gz with md5 cccccccc with sha1 bbbb
+Patch0: fix.patch with sha256 2222
+`
+	if got := joinSpecLines(lines); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestUpdateChecksums(t *testing.T) {
+	ignore := true
+	savedIgnoreDeps := ignoreDeps
+	defer func() { ignoreDeps = savedIgnoreDeps }()
+	ignoreDeps = &ignore
+	dir := t.TempDir()
+	saved := directories
+	defer func() { directories = saved }()
+	directories = buildDirectories{Sources: dir}
+
+	for name, contents := range map[string]string{"a.txt": "a\n", "b.txt": "b\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	specPath := filepath.Join(dir, "hello.spec")
+	spec := `Name: hello
+Version: 1.0
+Release: 1
+Summary: Says \
+	hello
+License: MIT
+Source0: a.txt with md5 ` + strings.Repeat("0", 32) + `
+Source1: b.txt with sha1 ` + strings.Repeat("0", 40) + `
+`
+	if err := ioutil.WriteFile(specPath, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateChecksums(specPath); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := md5.Sum([]byte("a\n")), sha1.Sum([]byte("b\n"))
+	expected := strings.Replace(spec, strings.Repeat("0", 32), hex.EncodeToString(a[:]), 1)
+	expected = strings.Replace(expected, strings.Repeat("0", 40), hex.EncodeToString(b[:]), 1)
+	if data, err := ioutil.ReadFile(specPath); err != nil || string(data) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, data)
+	}
+}
@@ -4,12 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"math/rand"
-	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 /*
@@ -60,6 +59,14 @@ func isValidUrl(toTest string) bool {
 	}
 }
 
+// specDirectory returns the directory containing the specfile being built.
+func specDirectory() string {
+	if filepath.IsAbs(*buildFile) {
+		return filepath.Dir(*buildFile)
+	}
+	return filepath.Dir(filepath.Join(startPWD, *buildFile))
+}
+
 func copyFile(src, dst string) (int64, error) {
 	sourceFileStat, err := os.Stat(src)
 	if err != nil {
@@ -85,24 +92,52 @@ func copyFile(src, dst string) (int64, error) {
 	return nBytes, err
 }
 
-func downloadFile(filepath string, url string) error {
+// ficlone is the ioctl that makes a file share the data of another, on
+// filesystems that can, such as btrfs and XFS.
+const ficlone = 0x40049409
 
-	// Get the data
-	resp, err := http.Get(url)
+// cloneFile copies src to dst, replacing dst. Where the filesystem can,
+// the copy is a reflink, which shares the data of src until either file is
+// changed, so it's as cheap as a hard link without changes to one of them
+// showing up in the other.
+func cloneFile(src, dst string) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	source, err := os.Open(src)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	// Create the file
-	out, err := os.Create(filepath)
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	destination, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	defer destination.Close()
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, destination.Fd(), ficlone, source.Fd())
+	if errno != 0 {
+		_, err = io.Copy(destination, source)
+	}
+	if err == nil {
+		err = destination.Close()
+	}
+	return err
+}
 
-	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
+// linkFile hard links src to dst, replacing dst. Files are copied instead if
+// they live on different filesystems.
+func linkFile(src, dst string) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	_, err := copyFile(src, dst)
 	return err
 }
 
@@ -140,9 +175,3 @@ func prettyPrint(i interface{}) string {
 	s, _ := json.MarshalIndent(i, "", "\t")
 	return string(s)
 }
-
-func writeTempfile(contents string) (string, error) {
-	filename := fmt.Sprintf("/tmp/%d.alpmbuild.sh", rand.Int63())
-	err := ioutil.WriteFile(filename, []byte(contents), os.ModePerm)
-	return filename, err
-}
@@ -1,6 +1,10 @@
 package lib
 
-import "testing"
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
 
 func TestFlagGrab(t *testing.T) {
 	value, hasFlag := grabFlagFromString("%package -n cyanogen -q pingas", "n", []string{"q"})
@@ -10,3 +14,19 @@ func TestFlagGrab(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestCloneFile(t *testing.T) {
+	dir := t.TempDir()
+	cached, source := filepath.Join(dir, "cached"), filepath.Join(dir, "source")
+	ioutil.WriteFile(cached, []byte("original"), 0644)
+	if err := cloneFile(cached, source); err != nil {
+		t.Fatal(err)
+	}
+	// Like sed -i in %prep, which writes the file in place.
+	if err := ioutil.WriteFile(source, []byte("patched"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(cached); string(data) != "original" {
+		t.Errorf("changing the copy changed the cached file to %q", data)
+	}
+}
@@ -0,0 +1,335 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+   alpmbuild — a tool to build arch packages from RPM specfiles
+
+   Copyright (C) 2020  Carson Black
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// vcsSource is a Source that is checked out of a version control system
+// instead of being downloaded. They are written like makepkg's VCS sources:
+//
+//	git+https://example.org/project.git#tag=v1.2
+//
+// The optional fragment pins the source to a revision.
+type vcsSource struct {
+	Kind string
+	// URL is the repository URL without the prefix and fragment.
+	URL string
+	// Pin is tag, commit, branch or revision, and Ref is its value.
+	Pin string
+	Ref string
+}
+
+// vcsPins lists the fragments each VCS understands.
+var vcsPins = map[string][]string{
+	"git": {"tag", "commit", "branch"},
+	"hg":  {"tag", "revision", "branch"},
+	"svn": {"revision"},
+}
+
+// parseVCSSource reports whether url names a VCS source, and whether its
+// fragment makes sense for that VCS.
+func parseVCSSource(url string) (vcsSource, bool, error) {
+	var vcs vcsSource
+	for kind := range vcsPins {
+		if strings.HasPrefix(url, kind+"+") {
+			vcs.Kind = kind
+			url = strings.TrimPrefix(url, kind+"+")
+		} else if kind == "git" && strings.HasPrefix(url, "git://") {
+			vcs.Kind = kind
+		}
+	}
+	if vcs.Kind == "" {
+		return vcs, false, nil
+	}
+
+	vcs.URL = url
+	if index := strings.Index(url, "#"); index != -1 {
+		vcs.URL = url[:index]
+		fragment := strings.SplitN(url[index+1:], "=", 2)
+		if len(fragment) != 2 || fragment[1] == "" {
+			return vcs, true, fmt.Errorf("%s should look like %s", highlight("#"+url[index+1:]), highlight("#"+vcsPins[vcs.Kind][0]+"=..."))
+		}
+		vcs.Pin, vcs.Ref = fragment[0], fragment[1]
+		valid := false
+		for _, pin := range vcsPins[vcs.Kind] {
+			valid = valid || pin == vcs.Pin
+		}
+		if !valid {
+			return vcs, true, fmt.Errorf(
+				"%s sources can't be pinned to a %s. Did you mean to use %s?",
+				vcs.Kind, highlight(vcs.Pin), highlight(ClosestString(vcs.Pin, vcsPins[vcs.Kind])),
+			)
+		}
+	}
+	return vcs, true, nil
+}
+
+// vcs returns source as a VCS source, if it is one.
+func (source Source) vcs() (vcsSource, bool) {
+	vcs, ok, err := parseVCSSource(source.URL)
+	return vcs, ok && err == nil
+}
+
+// name is the directory a checkout of the repository gets.
+func (vcs vcsSource) name() string {
+	return strings.TrimSuffix(path.Base(strings.TrimSuffix(vcs.URL, "/")), ".git")
+}
+
+// mirror is where the repository is kept in the source cache. The URL is
+// part of the name, since different forks usually share a name.
+func (vcs vcsSource) mirror(cache sourceCache) string {
+	sum := sha256.Sum256([]byte(vcs.URL))
+	return filepath.Join(cache.root, cacheVCSDirectory, vcs.Kind, vcs.name()+"-"+hex.EncodeToString(sum[:6]))
+}
+
+// runCommand runs a command in dir and returns its output. The output of a
+// command that fails is its error.
+func runCommand(dir string, command string, args ...string) (string, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		message := strings.TrimSpace(string(output))
+		if message == "" {
+			message = err.Error()
+		}
+		return "", fmt.Errorf("%s %s failed:\n%s", command, strings.Join(args, " "), message)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// hasCommit reports whether a git mirror already contains the pinned
+// commit, in which case there's nothing new to fetch.
+func (vcs vcsSource) hasCommit(mirror string) bool {
+	if vcs.Kind != "git" || vcs.Pin != "commit" {
+		return false
+	}
+	_, err := runCommand(mirror, "git", "cat-file", "-e", vcs.Ref+"^{commit}")
+	return err == nil
+}
+
+// updateMirror creates the mirror of the repository or brings it up to date.
+// git and hg keep a bare repository; svn has no such thing, so it keeps a
+// working copy of the pinned revision instead.
+func (vcs vcsSource) updateMirror(mirror string) error {
+	if _, err := os.Stat(mirror); err == nil {
+		if vcs.hasCommit(mirror) {
+			return nil
+		}
+		outputStatus("Updating " + highlight(vcs.URL) + "...")
+		switch vcs.Kind {
+		case "git":
+			_, err = runCommand(mirror, "git", "fetch", "--quiet", "--prune", "origin")
+		case "hg":
+			_, err = runCommand(mirror, "hg", "pull", "--quiet")
+		case "svn":
+			_, err = runCommand(mirror, "svn", "update", "--quiet", "--revision", vcs.revision())
+		}
+		return err
+	}
+
+	err := os.MkdirAll(filepath.Dir(mirror), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	outputStatus("Cloning " + highlight(vcs.URL) + "...")
+	partial := mirror + cachePartialSuffix
+	os.RemoveAll(partial)
+	switch vcs.Kind {
+	case "git":
+		_, err = runCommand("", "git", "clone", "--quiet", "--mirror", vcs.URL, partial)
+	case "hg":
+		_, err = runCommand("", "hg", "clone", "--quiet", "--noupdate", vcs.URL, partial)
+	case "svn":
+		_, err = runCommand("", "svn", "checkout", "--quiet", "--revision", vcs.revision(), vcs.URL, partial)
+	}
+	if err != nil {
+		os.RemoveAll(partial)
+		return err
+	}
+	return os.Rename(partial, mirror)
+}
+
+// revision is the revision expression the pin stands for.
+func (vcs vcsSource) revision() string {
+	switch {
+	case vcs.Kind == "git" && vcs.Pin == "tag":
+		return "refs/tags/" + vcs.Ref + "^{commit}"
+	case vcs.Kind == "git" && vcs.Pin == "branch":
+		return "refs/heads/" + vcs.Ref + "^{commit}"
+	case vcs.Kind == "git" && vcs.Pin == "commit":
+		return vcs.Ref + "^{commit}"
+	case vcs.Kind == "git":
+		return "HEAD^{commit}"
+	case vcs.Ref != "":
+		return vcs.Ref
+	case vcs.Kind == "hg":
+		return "default"
+	}
+	return "HEAD"
+}
+
+// resolve returns the full commit hash or revision number the pin points
+// to in the mirror.
+func (vcs vcsSource) resolve(mirror string) (string, error) {
+	switch vcs.Kind {
+	case "git":
+		return runCommand(mirror, "git", "rev-parse", "--verify", "--quiet", vcs.revision())
+	case "hg":
+		return runCommand(mirror, "hg", "log", "--rev", vcs.revision(), "--template", "{node}")
+	}
+	return runCommand(mirror, "svn", "info", "--show-item", "revision")
+}
+
+// current returns the revision a checkout is at, or nothing if it isn't a
+// checkout.
+func (vcs vcsSource) current(target string) string {
+	if _, err := os.Stat(target); err != nil {
+		return ""
+	}
+	var revision string
+	switch vcs.Kind {
+	case "git":
+		revision, _ = runCommand(target, "git", "rev-parse", "HEAD")
+	case "hg":
+		revision, _ = runCommand(target, "hg", "log", "--rev", ".", "--template", "{node}")
+	case "svn":
+		revision, _ = runCommand(target, "svn", "info", "--show-item", "revision")
+	}
+	return revision
+}
+
+// checkout creates a working copy of revision at target from the mirror.
+func (vcs vcsSource) checkout(mirror, target, revision string) error {
+	err := os.RemoveAll(target)
+	if err != nil {
+		return err
+	}
+	switch vcs.Kind {
+	case "git":
+		_, err = runCommand("", "git", "clone", "--quiet", "--no-checkout", mirror, target)
+		if err == nil {
+			_, err = runCommand(target, "git", "checkout", "--quiet", "--detach", revision)
+		}
+		if err == nil {
+			_, err = runCommand(target, "git", "remote", "set-url", "origin", vcs.URL)
+		}
+	case "hg":
+		_, err = runCommand("", "hg", "clone", "--quiet", "--updaterev", revision, mirror, target)
+	case "svn":
+		_, err = runCommand("", "cp", "-a", mirror, target)
+	}
+	return err
+}
+
+// mirrorVCS returns the mirror of a repository in the cache, creating or
+// updating it first. A mirror from a bundle is copied into the cache if the
+// cache doesn't have one yet. Offline, mirrors are used as they are.
+func (cache sourceCache) mirrorVCS(vcs vcsSource) (string, error) {
+	mirror := vcs.mirror(cache)
+
+	lock, err := lockCacheEntry(mirror)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Close()
+
+	if _, err := os.Stat(mirror); os.IsNotExist(err) {
+		for _, bundle := range cache.bundles {
+			bundled := vcs.mirror(sourceCache{root: bundle})
+			if _, err := os.Stat(bundled); err != nil {
+				continue
+			}
+			outputStatus("Copying " + highlight(vcs.URL) + " from " + highlight(bundle) + "...")
+			err = os.MkdirAll(filepath.Dir(mirror), os.ModePerm)
+			if err == nil {
+				_, err = runCommand("", "cp", "-a", bundled, mirror+cachePartialSuffix)
+			}
+			if err == nil {
+				err = os.Rename(mirror+cachePartialSuffix, mirror)
+			}
+			if err != nil {
+				os.RemoveAll(mirror + cachePartialSuffix)
+				return "", err
+			}
+			break
+		}
+	}
+
+	if cache.offline {
+		if _, err := os.Stat(mirror); err != nil {
+			return "", &offlineError{URL: vcs.URL}
+		}
+		return mirror, nil
+	}
+	err = vcs.updateMirror(mirror)
+	if err != nil {
+		return "", err
+	}
+	return mirror, ioutil.WriteFile(mirror+cacheURLSuffix, []byte(vcs.URL+"\n"), 0644)
+}
+
+// fetchVCS checks source out into target, going through a mirror in the
+// cache. It returns the revision that was checked out.
+func (cache sourceCache) fetchVCS(source Source, target string) (string, error) {
+	vcs, _ := source.vcs()
+	mirror, err := cache.mirrorVCS(vcs)
+	if err != nil {
+		return "", err
+	}
+
+	lock, err := lockCacheEntry(mirror)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Close()
+
+	revision, err := vcs.resolve(mirror)
+	if err != nil {
+		wanted := "the default branch"
+		if vcs.Pin != "" {
+			wanted = vcs.Pin + " " + highlight(vcs.Ref)
+		}
+		return "", fmt.Errorf("could not find %s in %s: %s", wanted, vcs.URL, err.Error())
+	}
+
+	// The mirror was used, so it isn't pruned.
+	now := time.Now()
+	os.Chtimes(mirror, now, now)
+
+	// Leave a checkout of the right revision alone, so that sources are
+	// only checked out once per build.
+	if vcs.current(target) == revision {
+		return revision, nil
+	}
+	outputStatus(fmt.Sprintf("Checking out %s at %s...", highlight(vcs.URL), highlight(revision)))
+	return revision, vcs.checkout(mirror, target, revision)
+}
@@ -0,0 +1,37 @@
+package lib
+
+import "testing"
+
+func TestParseVCSSource(t *testing.T) {
+	tests := []struct {
+		url   string
+		isVCS bool
+		valid bool
+		vcs   vcsSource
+		name  string
+	}{
+		{"https://example.org/hello-1.0.tar.gz", false, true, vcsSource{}, ""},
+		{"git+https://example.org/hello.git#tag=v1.2", true, true, vcsSource{"git", "https://example.org/hello.git", "tag", "v1.2"}, "hello"},
+		{"git://example.org/hello", true, true, vcsSource{"git", "git://example.org/hello", "", ""}, "hello"},
+		{"hg+https://example.org/hello#branch=stable", true, true, vcsSource{"hg", "https://example.org/hello", "branch", "stable"}, "hello"},
+		{"svn+https://example.org/hello/trunk/#revision=42", true, true, vcsSource{"svn", "https://example.org/hello/trunk/", "revision", "42"}, "trunk"},
+		{"git+https://example.org/hello.git#revision=42", true, false, vcsSource{}, ""},
+		{"git+https://example.org/hello.git#tag", true, false, vcsSource{}, ""},
+	}
+	for _, test := range tests {
+		vcs, isVCS, err := parseVCSSource(test.url)
+		if isVCS != test.isVCS || (err == nil) != test.valid {
+			t.Errorf("%s: expected VCS %v and valid %v, got %v and %v", test.url, test.isVCS, test.valid, isVCS, err)
+			continue
+		}
+		if !test.isVCS || !test.valid {
+			continue
+		}
+		if vcs != test.vcs {
+			t.Errorf("%s: expected %+v, got %+v", test.url, test.vcs, vcs)
+		}
+		if vcs.name() != test.name {
+			t.Errorf("%s: expected the checkout to be called %s, got %s", test.url, test.name, vcs.name())
+		}
+	}
+}